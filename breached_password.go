@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The breached password index is a file of the SHA-1 hashes of breached passwords with their
+// prevalence, sorted by hash so a lookup is a binary search on disk. The layout is
+//
+//	header   magic "CBPI", version uint32, record count uint64
+//	fanout   65536 uint64, the number of records whose first two hash bytes are <= the index
+//	records  SHA-1 hash [20]byte, prevalence uint32
+//
+// all integers big endian.
+const (
+	breachedIndexMagic      = "CBPI"
+	breachedIndexVersion    = 1
+	breachedIndexHeaderSize = 16
+	breachedIndexFanout     = 1 << 16
+	breachedIndexRecordSize = sha1.Size + 4
+	breachedIndexDataOffset = breachedIndexHeaderSize + breachedIndexFanout*8
+)
+
+// BreachedPasswordIndex looks up the prevalence of passwords in a breached password index file.
+type BreachedPasswordIndex struct {
+	file   *os.File
+	fanout []uint64
+}
+
+func OpenBreachedPasswordIndex(path string) (*BreachedPasswordIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	index := &BreachedPasswordIndex{file: file, fanout: make([]uint64, breachedIndexFanout)}
+	header := make([]byte, breachedIndexDataOffset)
+	if _, err = file.ReadAt(header, 0); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("invalid breached password index: %w", err)
+	}
+	if string(header[:4]) != breachedIndexMagic || binary.BigEndian.Uint32(header[4:8]) != breachedIndexVersion {
+		_ = file.Close()
+		return nil, errors.New("invalid breached password index")
+	}
+	for i := range index.fanout {
+		offset := breachedIndexHeaderSize + i*8
+		index.fanout[i] = binary.BigEndian.Uint64(header[offset : offset+8])
+	}
+	if index.fanout[breachedIndexFanout-1] != binary.BigEndian.Uint64(header[8:16]) {
+		_ = file.Close()
+		return nil, errors.New("invalid breached password index")
+	}
+	return index, nil
+}
+
+func (b *BreachedPasswordIndex) Close() error {
+	return b.file.Close()
+}
+
+// Prevalence returns how many times the password was seen in breaches, zero when it never was.
+func (b *BreachedPasswordIndex) Prevalence(password string) (uint32, error) {
+	hash := sha1.Sum([]byte(password))
+	bucket := int(binary.BigEndian.Uint16(hash[:2]))
+	low := uint64(0)
+	if bucket > 0 {
+		low = b.fanout[bucket-1]
+	}
+	high := b.fanout[bucket]
+	record := make([]byte, breachedIndexRecordSize)
+	for low < high {
+		middle := low + (high-low)/2
+		_, err := b.file.ReadAt(record, breachedIndexDataOffset+int64(middle)*breachedIndexRecordSize)
+		if err != nil {
+			return 0, err
+		}
+		switch bytes.Compare(record[:sha1.Size], hash[:]) {
+		case 0:
+			return binary.BigEndian.Uint32(record[sha1.Size:]), nil
+		case -1:
+			low = middle + 1
+		default:
+			high = middle
+		}
+	}
+	return 0, nil
+}
+
+// BuildBreachedPasswordIndex writes the index of the range files found in rangeDir to output. The
+// range files are the ones of the pwned passwords k-anonymity API: named after the five hex digit
+// prefix of the hashes, with a SUFFIX:COUNT line per hash. It returns the number of hashes indexed.
+func BuildBreachedPasswordIndex(rangeDir string, output string) (uint64, error) {
+	entries, err := ioutil.ReadDir(rangeDir)
+	if err != nil {
+		return 0, err
+	}
+	var prefixes []string
+	for _, entry := range entries {
+		name := strings.ToUpper(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		if entry.IsDir() || len(name) != 5 {
+			continue
+		}
+		if _, err := hex.DecodeString(name + "0"); err != nil {
+			continue
+		}
+		prefixes = append(prefixes, entry.Name())
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return strings.ToUpper(prefixes[i]) < strings.ToUpper(prefixes[j])
+	})
+	file, err := os.Create(output)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err = file.Write(make([]byte, breachedIndexDataOffset)); err != nil {
+		return 0, err
+	}
+	writer := bufio.NewWriter(file)
+	fanout := make([]uint64, breachedIndexFanout)
+	var count uint64
+	for _, name := range prefixes {
+		records, err := readRangeFile(filepath.Join(rangeDir, name))
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			if _, err = writer.Write(record); err != nil {
+				return 0, err
+			}
+			fanout[binary.BigEndian.Uint16(record[:2])]++
+			count++
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return 0, err
+	}
+	header := make([]byte, breachedIndexDataOffset)
+	copy(header, breachedIndexMagic)
+	binary.BigEndian.PutUint32(header[4:8], breachedIndexVersion)
+	binary.BigEndian.PutUint64(header[8:16], count)
+	cumulative := uint64(0)
+	for i, bucketCount := range fanout {
+		cumulative += bucketCount
+		binary.BigEndian.PutUint64(header[breachedIndexHeaderSize+i*8:], cumulative)
+	}
+	if _, err = file.WriteAt(header, 0); err != nil {
+		return 0, err
+	}
+	return count, file.Sync()
+}
+
+func readRangeFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	prefix := strings.ToUpper(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	var records [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line in range file %s: %s", path, line)
+		}
+		hash, err := hex.DecodeString(prefix + strings.ToUpper(parts[0]))
+		if err != nil || len(hash) != sha1.Size {
+			return nil, fmt.Errorf("invalid hash in range file %s: %s", path, line)
+		}
+		prevalence, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count in range file %s: %s", path, line)
+		}
+		record := make([]byte, breachedIndexRecordSize)
+		copy(record, hash)
+		binary.BigEndian.PutUint32(record[sha1.Size:], uint32(prevalence))
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return bytes.Compare(records[i][:sha1.Size], records[j][:sha1.Size]) < 0
+	})
+	return records, nil
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRangeFiles(t *testing.T, dir string, prevalence map[string]string) {
+	ranges := map[string][]string{}
+	for password, count := range prevalence {
+		hash := sha1.Sum([]byte(password))
+		encoded := strings.ToUpper(hex.EncodeToString(hash[:]))
+		ranges[encoded[:5]] = append(ranges[encoded[:5]], encoded[5:]+":"+count)
+	}
+	for prefix, lines := range ranges {
+		err := ioutil.WriteFile(filepath.Join(dir, prefix), []byte(strings.Join(lines, "\r\n")), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBreachedPasswordIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breached")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	rangeDir := filepath.Join(dir, "ranges")
+	if !assert.NoError(t, os.Mkdir(rangeDir, 0700)) {
+		return
+	}
+	writeRangeFiles(t, rangeDir, map[string]string{"password": "9545824", "letmein": "3", "rare one": "1"})
+	indexFile := filepath.Join(dir, "breached.idx")
+	count, err := BuildBreachedPasswordIndex(rangeDir, indexFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(3), count)
+	t.Run("lookup", func(t *testing.T) {
+		index, err := OpenBreachedPasswordIndex(indexFile)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer index.Close()
+		for password, expected := range map[string]uint32{"password": 9545824, "letmein": 3, "rare one": 1, "never seen": 0} {
+			prevalence, err := index.Prevalence(password)
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, prevalence, password)
+			}
+		}
+	})
+	t.Run("policy threshold", func(t *testing.T) {
+		engine := NewPasswordPolicyEngine(PasswordPolicy{BreachedIndexFile: indexFile, BreachedThreshold: 1})
+		defer engine.Close()
+		violations, err := engine.Validate(nil, "letmein")
+		if assert.NoError(t, err) {
+			assert.Equal(t, []PasswordViolation{{Rule: ViolationBreached, Limit: 1}}, violations)
+		}
+		violations, err = engine.Validate(nil, "rare one")
+		if assert.NoError(t, err) {
+			assert.Empty(t, violations)
+		}
+	})
+	t.Run("invalid index", func(t *testing.T) {
+		_, err := OpenBreachedPasswordIndex(filepath.Join(rangeDir, "missing"))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,28 @@
+// Command breachindex builds the breached password index used by the password policy from the
+// range files of the pwned passwords k-anonymity API.
+//
+//	breachindex -ranges ./pwnedpasswords -out breached.idx
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/identityOrg/cerberus-core"
+	"os"
+)
+
+func main() {
+	rangeDir := flag.String("ranges", "", "directory of the downloaded range files")
+	output := flag.String("out", "breached.idx", "index file to write")
+	flag.Parse()
+	if *rangeDir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	count, err := core.BuildBreachedPasswordIndex(*rangeDir, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("indexed %d hashes into %s\n", count, *output)
+}
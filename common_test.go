@@ -38,7 +38,10 @@ func init() {
 	TestDb = TestDb.Debug()
 	TestDb.AutoMigrate(&models.UserModel{}, &models.UserCredentials{}, &models.TokensModel{},
 		&models.ServiceProviderModel{}, &models.ScopeModel{}, &models.ClaimModel{}, &models.SecretChannelModel{},
-		&models.SecretModel{})
+		&models.SecretModel{}, &models.SecretTombstoneModel{}, &models.UserPasswordHistory{},
+		&models.UserResetToken{}, &models.UserOTP{}, &models.UserTOTPEnrollment{},
+		&models.UserRecoveryCode{}, &models.UserWebAuthnChallenge{}, &models.UserEmailVerification{},
+		&models.UserLoginToken{})
 	err = TestDb.Delete(&models.UserCredentials{}, "user_id = ?", 1).Error
 	if err != nil {
 		panic(err)
@@ -7,5 +7,49 @@ type Config struct {
 	MaxInvalidLoginAttempt uint
 	InvalidAttemptWindow   time.Duration
 	TOTPSecretLength       uint
-	PasswordCost           int
+	TOTPEnrollmentTTL      time.Duration
+	TOTPPeriod             uint
+	TOTPDigits             uint8
+	TOTPAlgorithm          string
+	TOTPSkew               uint
+	RecoveryCodeCount      uint
+	WebAuthnRPID           string
+	WebAuthnRPName         string
+	WebAuthnOrigins        []string
+	WebAuthnTimeout        time.Duration
+	// WebAuthnUserVerification is required, preferred or discouraged
+	WebAuthnUserVerification        string
+	PasswordCost                    int
+	PasswordHashAlgorithm           string
+	Argon2Memory                    uint32
+	Argon2Iterations                uint32
+	Argon2Parallelism               uint8
+	ScryptCost                      uint8
+	PBKDF2Iterations                int
+	PasswordPolicy                  PasswordPolicy
+	PasswordHistorySize             uint
+	PasswordMaxAge                  time.Duration
+	PasswordResetTTL                time.Duration
+	OTPTTL                          time.Duration
+	OTPMaxAttempts                  uint
+	SMTPAddress                     string
+	SMTPUsername                    string
+	SMTPPassword                    string
+	SMTPFrom                        string
+	EmailVerificationTTL            time.Duration
+	EmailVerificationResendInterval time.Duration
+	EmailVerificationMaxSends       uint
+	// EmailVerificationURL is the page the verification link points to, the token is added as the
+	// token query parameter
+	EmailVerificationURL       string
+	EmailVerificationActivates bool
+	MagicLinkTTL               time.Duration
+	MagicLinkResendInterval    time.Duration
+	MagicLinkMaxSends          uint
+	// MagicLinkURL is the page the sign in link points to, the token is added as the token query
+	// parameter
+	MagicLinkURL string
+	// DevNotificationFile receives the messages of both channels instead of a real sender, "-" for
+	// stdout. For development only, the codes and tokens are written in plain text
+	DevNotificationFile string
 }
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"io"
+)
+
+const CustodyDatabase = "database"
+
+// DatabaseKeyCustody keeps the key material in t_secret, envelope encrypted with a data key wrapped
+// by the text encrypter.
+type DatabaseKeyCustody struct {
+	TextEnc ITextEncrypts
+	TextDec ITextDecrypts
+}
+
+func NewDatabaseKeyCustody(dec ITextDecrypts, enc ITextEncrypts) *DatabaseKeyCustody {
+	return &DatabaseKeyCustody{TextEnc: enc, TextDec: dec}
+}
+
+func (d *DatabaseKeyCustody) Name() string {
+	return CustodyDatabase
+}
+
+func (d *DatabaseKeyCustody) GenerateKey(ctx context.Context, secret *models.SecretModel) error {
+	material, err := generateKeyMaterial(secret.Algorithm)
+	if err != nil {
+		return err
+	}
+	return d.Seal(ctx, secret, material)
+}
+
+func (d *DatabaseKeyCustody) PublicKey(ctx context.Context, secret *models.SecretModel) (crypto.PublicKey, error) {
+	key, err := d.PrivateKey(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer.Public(), nil
+	}
+	return nil, fmt.Errorf("secret %s has no public key", secret.KeyId)
+}
+
+func (d *DatabaseKeyCustody) Sign(ctx context.Context, secret *models.SecretModel, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key, err := d.PrivateKey(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer.Sign(rand.Reader, digest, opts)
+	}
+	return nil, fmt.Errorf("secret %s can not sign a digest", secret.KeyId)
+}
+
+// PrivateKey returns the raw key for symmetric algorithms, otherwise the parsed private key.
+func (d *DatabaseKeyCustody) PrivateKey(ctx context.Context, secret *models.SecretModel) (interface{}, error) {
+	material, err := d.Open(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	if IsSymmetricAlgorithm(secret.Algorithm) {
+		return material, nil
+	}
+	return x509.ParsePKCS8PrivateKey(material)
+}
+
+// Seal stores the key material envelope encrypted, so that a dump of t_secret does not disclose
+// any key without the text decrypter.
+func (d *DatabaseKeyCustody) Seal(ctx context.Context, secret *models.SecretModel, material []byte) error {
+	sealed, wrappedKey, err := sealEnvelope(ctx, d.TextEnc, material)
+	if err != nil {
+		return err
+	}
+	secret.Value = sealed
+	secret.WrappedKey = wrappedKey
+	return nil
+}
+
+func (d *DatabaseKeyCustody) Open(ctx context.Context, secret *models.SecretModel) ([]byte, error) {
+	if secret.WrappedKey != "" {
+		material, err := openEnvelope(ctx, d.TextDec, secret.Value, secret.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret %s - %v", secret.KeyId, err)
+		}
+		return material, nil
+	}
+	// secrets stored before envelope encryption, see SecretStoreServiceImpl.EncryptSecrets
+	if IsSymmetricAlgorithm(secret.Algorithm) {
+		decrypted, err := d.TextDec.DecryptText(ctx, string(secret.Value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret %s - %v", secret.KeyId, err)
+		}
+		return base64.RawURLEncoding.DecodeString(decrypted)
+	}
+	return secret.Value, nil
+}
+
+// custodySigner adapts a key custody to crypto.Signer.
+type custodySigner struct {
+	ctx       context.Context
+	custody   IKeyCustody
+	secret    *models.SecretModel
+	publicKey crypto.PublicKey
+}
+
+func (c *custodySigner) Public() crypto.PublicKey {
+	return c.publicKey
+}
+
+func (c *custodySigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return c.custody.Sign(c.ctx, c.secret, digest, opts)
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	defaultEmailVerificationTTL            = 24 * time.Hour
+	defaultEmailVerificationResendInterval = time.Minute
+	defaultEmailVerificationMaxSends       = 5
+	sendWindow                             = 24 * time.Hour
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("invalid or expired email verification token")
+	ErrVerificationRateLimited  = errors.New("email verification sent too often, try again later")
+	ErrEmailAddressTaken        = errors.New("email address is already used by another user")
+)
+
+// EmailVerificationServiceImpl verifies the address a new user signed up with, which CreateUser keeps
+// in TempEmailAddress. Verification tokens are random, stored hashed, expire after
+// Config.EmailVerificationTTL and can be used once. Sending a token again revokes the previous one,
+// and is limited to one send per Config.EmailVerificationResendInterval and
+// Config.EmailVerificationMaxSends sends a day.
+type EmailVerificationServiceImpl struct {
+	Db       *gorm.DB
+	Config   *Config
+	Notifier INotificationService
+}
+
+func NewEmailVerificationServiceImpl(db *gorm.DB, config *Config, notifier INotificationService) *EmailVerificationServiceImpl {
+	return &EmailVerificationServiceImpl{Db: db, Config: config, Notifier: notifier}
+}
+
+// SendEmailVerification issues a verification token for the pending address of the user and emails
+// it there, with a link to Config.EmailVerificationURL when set.
+func (e *EmailVerificationServiceImpl) SendEmailVerification(ctx context.Context, id uint) error {
+	db := e.Db.WithContext(ctx)
+	user := &models.UserModel{}
+	user.ID = id
+	result := db.Find(user)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return fmt.Errorf("user not found with id %d", id)
+	}
+	if user.TempEmailAddress == "" {
+		return errors.New("no email address pending verification")
+	}
+	verification := &models.UserEmailVerification{}
+	result = db.Find(verification, "user_id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	now := time.Now()
+	exists := result.RowsAffected == 1
+	if exists {
+		if err := e.checkRateLimit(verification, now); err != nil {
+			return err
+		}
+	} else {
+		verification = &models.UserEmailVerification{UserID: id, WindowStart: now}
+	}
+	previousHash := verification.TokenHash
+	random, err := GenerateRandomBytes(resetTokenLength)
+	if err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	ttl := e.Config.EmailVerificationTTL
+	if ttl <= 0 {
+		ttl = defaultEmailVerificationTTL
+	}
+	verification.Email = user.TempEmailAddress
+	verification.TokenHash = hashResetToken(token)
+	verification.ExpiresAt = now.Add(ttl)
+	verification.LastSentAt = now
+	verification.SendCount++
+	if err = e.saveVerification(db, verification, exists, previousHash); err != nil {
+		return err
+	}
+	message := newNotificationMessage(token, verification.ExpiresAt)
+	if message.Link, err = tokenLink(e.Config.EmailVerificationURL, token); err != nil {
+		return err
+	}
+	return e.Notifier.Notify(ctx, user, NotificationChannelEmail, verification.Email, TemplateEmailVerify, message)
+}
+
+// saveVerification stores the sent token. The update only applies while the row still holds the
+// previous token, so that concurrent sends can not both pass the rate limit; the one that loses is
+// rate limited, as is the loser of two concurrent first sends on the unique user index.
+func (e *EmailVerificationServiceImpl) saveVerification(db *gorm.DB, verification *models.UserEmailVerification, exists bool, previousHash string) error {
+	if !exists {
+		if err := db.Create(verification).Error; err != nil {
+			var count int64
+			if db.Model(&models.UserEmailVerification{}).Where("user_id = ?", verification.UserID).Count(&count); count > 0 {
+				return ErrVerificationRateLimited
+			}
+			return err
+		}
+		return nil
+	}
+	result := db.Model(&models.UserEmailVerification{}).
+		Where("id = ? and token_hash = ?", verification.ID, previousHash).
+		Updates(map[string]interface{}{
+			"email":        verification.Email,
+			"token_hash":   verification.TokenHash,
+			"expires_at":   verification.ExpiresAt,
+			"last_sent_at": verification.LastSentAt,
+			"window_start": verification.WindowStart,
+			"send_count":   verification.SendCount,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrVerificationRateLimited
+	}
+	return nil
+}
+
+func (e *EmailVerificationServiceImpl) checkRateLimit(verification *models.UserEmailVerification, now time.Time) error {
+	interval := e.Config.EmailVerificationResendInterval
+	if interval <= 0 {
+		interval = defaultEmailVerificationResendInterval
+	}
+	maxSends := e.Config.EmailVerificationMaxSends
+	if maxSends == 0 {
+		maxSends = defaultEmailVerificationMaxSends
+	}
+	if !sendAllowed(verification.LastSentAt, &verification.WindowStart, &verification.SendCount, interval, maxSends, now) {
+		return ErrVerificationRateLimited
+	}
+	return nil
+}
+
+// sendAllowed tells whether another message may be sent, at most one per interval and maxSends a
+// day. The counter starts over, and the window moves to now, once the day of the window is over.
+func sendAllowed(lastSentAt time.Time, windowStart *time.Time, sendCount *uint, interval time.Duration, maxSends uint, now time.Time) bool {
+	if lastSentAt.Add(interval).After(now) {
+		return false
+	}
+	if windowStart.Add(sendWindow).Before(now) {
+		*windowStart = now
+		*sendCount = 0
+	}
+	return *sendCount < maxSends
+}
+
+// VerifyEmail uses the token and makes the address it was sent to the verified email of the user,
+// activating the user when Config.EmailVerificationActivates is set. A token sent to an address the
+// user has since replaced is rejected, and ErrEmailAddressTaken is returned when another user has
+// verified the same address first. It returns the id of the verified user.
+func (e *EmailVerificationServiceImpl) VerifyEmail(ctx context.Context, token string) (uint, error) {
+	db := e.Db.WithContext(ctx)
+	verification := &models.UserEmailVerification{}
+	result := db.Find(verification, "token_hash = ? and expires_at > ?", hashResetToken(token), time.Now())
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return 0, ErrInvalidVerificationToken
+	}
+	user := &models.UserModel{}
+	user.ID = verification.UserID
+	result = db.Find(user)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected != 1 || user.TempEmailAddress != verification.Email {
+		return 0, ErrInvalidVerificationToken
+	}
+	taken := func() (bool, error) {
+		var count int64
+		err := db.Model(&models.UserModel{}).Where("email_address = ? and id <> ?", verification.Email, user.ID).
+			Count(&count).Error
+		return count > 0, err
+	}
+	if isTaken, err := taken(); err != nil {
+		return 0, err
+	} else if isTaken {
+		return 0, ErrEmailAddressTaken
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		deleted := tx.Delete(verification)
+		if deleted.Error != nil {
+			return deleted.Error
+		}
+		if deleted.RowsAffected != 1 {
+			// verified concurrently, the token is already used
+			return ErrInvalidVerificationToken
+		}
+		if user.Metadata == nil {
+			user.Metadata = &models.UserMetadata{}
+		}
+		user.EmailAddress = verification.Email
+		user.TempEmailAddress = ""
+		user.Metadata.SetEmail(verification.Email)
+		user.Metadata.SetEmailVerified(true)
+		if e.Config.EmailVerificationActivates {
+			user.Inactive = false
+		}
+		return tx.Save(user).Error
+	})
+	if err != nil {
+		// the unique index rejects an address another user verified concurrently
+		if isTaken, _ := taken(); isTaken {
+			return 0, ErrEmailAddressTaken
+		}
+		return 0, err
+	}
+	return user.ID, nil
+}
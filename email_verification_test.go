@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestEmailVerificationServiceImpl(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		EmailVerificationURL:       "https://localhost:8080/verify?lang=en",
+		EmailVerificationActivates: true,
+		EmailVerificationMaxSends:  2,
+	}
+	notifier, output := newBufferNotifier(config)
+	userStore := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), notifier)
+	userStore.Db = beginTransaction(ctx, userStore.Db)
+	verification := NewEmailVerificationServiceImpl(userStore.Db, config, notifier)
+	tokenPattern := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+	id, err := userStore.CreateUser(ctx, "newuser", "new@domain.com", &models.UserMetadata{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = userStore.FindUserByEmail(ctx, "new@domain.com")
+	assert.Error(t, err, "not verified yet")
+	var first string
+	t.Run("send", func(t *testing.T) {
+		if !assert.NoError(t, verification.SendEmailVerification(ctx, id)) {
+			return
+		}
+		assert.Contains(t, output.String(), "To: new@domain.com")
+		assert.Contains(t, output.String(), "https://localhost:8080/verify?lang=en&token=")
+		first = tokenPattern.FindStringSubmatch(output.String())[1]
+		assert.Equal(t, ErrVerificationRateLimited, verification.SendEmailVerification(ctx, id))
+	})
+	t.Run("resend", func(t *testing.T) {
+		output.Reset()
+		userStore.Db.Model(&models.UserEmailVerification{}).Where("user_id = ?", id).
+			Update("last_sent_at", time.Now().Add(-time.Hour))
+		if !assert.NoError(t, verification.SendEmailVerification(ctx, id)) {
+			return
+		}
+		_, err := verification.VerifyEmail(ctx, first)
+		assert.Equal(t, ErrInvalidVerificationToken, err, "earlier token revoked")
+		userStore.Db.Model(&models.UserEmailVerification{}).Where("user_id = ?", id).
+			Update("last_sent_at", time.Now().Add(-time.Hour))
+		assert.Equal(t, ErrVerificationRateLimited, verification.SendEmailVerification(ctx, id), "max sends")
+	})
+	t.Run("concurrent send", func(t *testing.T) {
+		sent := &models.UserEmailVerification{}
+		if !assert.NoError(t, userStore.Db.First(sent, "user_id = ?", id).Error) {
+			return
+		}
+		previousHash := sent.TokenHash
+		sent.TokenHash = hashResetToken("other")
+		err := verification.saveVerification(userStore.Db, sent, true, hashResetToken("stale"))
+		assert.Equal(t, ErrVerificationRateLimited, err)
+		err = verification.saveVerification(userStore.Db, &models.UserEmailVerification{UserID: id}, false, "")
+		assert.Equal(t, ErrVerificationRateLimited, err)
+		userStore.Db.First(sent, "user_id = ?", id)
+		assert.Equal(t, previousHash, sent.TokenHash)
+	})
+	t.Run("verify", func(t *testing.T) {
+		token := tokenPattern.FindStringSubmatch(output.String())[1]
+		verifiedId, err := verification.VerifyEmail(ctx, token)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, id, verifiedId)
+		user, err := userStore.FindUserByEmail(ctx, "new@domain.com")
+		if assert.NoError(t, err) {
+			assert.False(t, user.Inactive)
+			assert.True(t, user.Metadata.GetEmailVerified())
+			assert.Equal(t, "", user.TempEmailAddress)
+		}
+		_, err = verification.VerifyEmail(ctx, token)
+		assert.Equal(t, ErrInvalidVerificationToken, err, "single use")
+		assert.Error(t, verification.SendEmailVerification(ctx, id), "nothing pending")
+	})
+	t.Run("address taken", func(t *testing.T) {
+		otherId, err := userStore.CreateUser(ctx, "otheruser", "new@domain.com", &models.UserMetadata{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		output.Reset()
+		if !assert.NoError(t, verification.SendEmailVerification(ctx, otherId)) {
+			return
+		}
+		token := tokenPattern.FindStringSubmatch(output.String())[1]
+		_, err = verification.VerifyEmail(ctx, token)
+		assert.Equal(t, ErrEmailAddressTaken, err)
+	})
+	rollbackTransaction(userStore.Db)
+}
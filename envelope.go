@@ -0,0 +1,62 @@
+package core
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+)
+
+const dataKeySize = 32
+
+// sealEnvelope encrypts the data with a fresh AES-256-GCM data key, the data key is returned wrapped
+// by the text encrypter. The sealed data carries the nonce as prefix.
+func sealEnvelope(ctx context.Context, enc ITextEncrypts, data []byte) (sealed []byte, wrappedKey string, err error) {
+	dataKey, err := GenerateRandomBytes(dataKeySize)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := newEnvelopeCipher(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce, err := GenerateRandomBytes(uint8(aead.NonceSize()))
+	if err != nil {
+		return nil, "", err
+	}
+	wrappedKey, err = enc.EncryptText(ctx, base64.StdEncoding.EncodeToString(dataKey))
+	if err != nil {
+		return nil, "", err
+	}
+	sealed = aead.Seal(nonce, nonce, data, nil)
+	return sealed, wrappedKey, nil
+}
+
+func openEnvelope(ctx context.Context, dec ITextDecrypts, sealed []byte, wrappedKey string) ([]byte, error) {
+	encodedKey, err := dec.DecryptText(ctx, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newEnvelopeCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	nonce, cipherText := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, cipherText, nil)
+}
+
+func newEnvelopeCipher(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -3,9 +3,11 @@ module github.com/identityOrg/cerberus-core
 go 1.14
 
 require (
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/google/uuid v1.1.1
 	github.com/google/wire v0.4.0
 	github.com/identityOrg/oidcsdk v0.7.7
+	github.com/miekg/pkcs11 v1.0.3
 	github.com/pquerna/otp v1.2.0
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
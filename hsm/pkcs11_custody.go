@@ -0,0 +1,350 @@
+package hsm
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/miekg/pkcs11"
+	"gopkg.in/square/go-jose.v2"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+const CustodyPKCS11 = "pkcs11"
+
+var (
+	_ core.IKeyCustody   = (*PKCS11KeyCustody)(nil)
+	_ core.IKeyDestroyer = (*PKCS11KeyCustody)(nil)
+)
+
+var (
+	oidP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// digestInfoPrefix is the DER prefix of the PKCS#1 v1.5 DigestInfo, CKM_RSA_PKCS expects it with
+// the digest.
+var digestInfoPrefix = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var pssParams = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// PKCS11KeyCustody keeps the signing keys in a PKCS#11 token, they are generated as non extractable
+// key pairs. The secret only holds the key handle, which is the CKA_ID of the key pair.
+type PKCS11KeyCustody struct {
+	module  *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	lock    sync.Mutex
+}
+
+// NewPKCS11KeyCustody loads the PKCS#11 module and logs in to the token with the given label.
+func NewPKCS11KeyCustody(modulePath string, tokenLabel string, pin string) (*PKCS11KeyCustody, error) {
+	module := pkcs11.New(modulePath)
+	if module == nil {
+		return nil, fmt.Errorf("failed to load pkcs11 module %s", modulePath)
+	}
+	err := module.Initialize()
+	if err != nil {
+		module.Destroy()
+		return nil, err
+	}
+	custody := &PKCS11KeyCustody{module: module}
+	err = custody.login(tokenLabel, pin)
+	if err != nil {
+		_ = module.Finalize()
+		module.Destroy()
+		return nil, err
+	}
+	return custody, nil
+}
+
+func (p *PKCS11KeyCustody) login(tokenLabel string, pin string) error {
+	slots, err := p.module.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		info, err := p.module.GetTokenInfo(slot)
+		if err != nil {
+			return err
+		}
+		if info.Label != tokenLabel {
+			continue
+		}
+		p.session, err = p.module.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return err
+		}
+		return p.module.Login(p.session, pkcs11.CKU_USER, pin)
+	}
+	return fmt.Errorf("pkcs11 token not found with label %s", tokenLabel)
+}
+
+// Close logs out of the token and unloads the module.
+func (p *PKCS11KeyCustody) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_ = p.module.Logout(p.session)
+	_ = p.module.CloseSession(p.session)
+	err := p.module.Finalize()
+	p.module.Destroy()
+	return err
+}
+
+func (p *PKCS11KeyCustody) Name() string {
+	return CustodyPKCS11
+}
+
+func (p *PKCS11KeyCustody) GenerateKey(_ context.Context, secret *models.SecretModel) error {
+	handle := []byte(secret.KeyId)
+	publicTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, handle),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, secret.KeyId),
+	}
+	privateTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, handle),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, secret.KeyId),
+	}
+	var mechanism uint
+	switch secret.Algorithm {
+	case string(jose.RS256), string(jose.PS256):
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate, rsaTemplate(2048)...)
+	case string(jose.RS384), string(jose.PS384):
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate, rsaTemplate(3072)...)
+	case string(jose.RS512), string(jose.PS512):
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate, rsaTemplate(4096)...)
+	case string(jose.ES256):
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate, ecTemplate(oidP256)...)
+	case string(jose.ES384):
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate, ecTemplate(oidP384)...)
+	case string(jose.ES512):
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate, ecTemplate(oidP521)...)
+	default:
+		return fmt.Errorf("algorithm %s is not supported by pkcs11 custody", secret.Algorithm)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	mechanisms := []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}
+	_, _, err := p.module.GenerateKeyPair(p.session, mechanisms, publicTemplate, privateTemplate)
+	if err != nil {
+		return err
+	}
+	secret.Value = handle
+	secret.WrappedKey = ""
+	return nil
+}
+
+func rsaTemplate(bits int) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+	}
+}
+
+func ecTemplate(curve asn1.ObjectIdentifier) []*pkcs11.Attribute {
+	params, _ := asn1.Marshal(curve)
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+	}
+}
+
+func (p *PKCS11KeyCustody) PublicKey(_ context.Context, secret *models.SecretModel) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	object, err := p.findObject(pkcs11.CKO_PUBLIC_KEY, secret.Value)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := p.module.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch bytesToUint(attributes[0].Value) {
+	case pkcs11.CKK_RSA:
+		attributes, err = p.module.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attributes[0].Value),
+			E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC:
+		attributes, err = p.module.GetAttributeValue(p.session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return parseECPublicKey(attributes[0].Value, attributes[1].Value)
+	default:
+		return nil, fmt.Errorf("unsupported key type of secret %s", secret.KeyId)
+	}
+}
+
+func parseECPublicKey(params []byte, encodedPoint []byte) (*ecdsa.PublicKey, error) {
+	var curveId asn1.ObjectIdentifier
+	_, err := asn1.Unmarshal(params, &curveId)
+	if err != nil {
+		return nil, err
+	}
+	var curve elliptic.Curve
+	switch {
+	case curveId.Equal(oidP256):
+		curve = elliptic.P256()
+	case curveId.Equal(oidP384):
+		curve = elliptic.P384()
+	case curveId.Equal(oidP521):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", curveId)
+	}
+	var point []byte
+	_, err = asn1.Unmarshal(encodedPoint, &point)
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.New("invalid ec point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// Sign signs the digest the way crypto.Signer does, ECDSA signatures are returned ASN.1 encoded.
+func (p *PKCS11KeyCustody) Sign(_ context.Context, secret *models.SecretModel, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	data := digest
+	switch {
+	case strings.HasPrefix(secret.Algorithm, "RS"):
+		prefix, ok := digestInfoPrefix[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		data = append(append([]byte{}, prefix...), digest...)
+	case strings.HasPrefix(secret.Algorithm, "PS"):
+		params, ok := pssParams[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+		}
+		saltLength := uint(opts.HashFunc().Size())
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok && pssOpts.SaltLength > 0 {
+			saltLength = uint(pssOpts.SaltLength)
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(params[0], params[1], saltLength))
+	case strings.HasPrefix(secret.Algorithm, "ES"):
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	default:
+		return nil, fmt.Errorf("algorithm %s is not supported by pkcs11 custody", secret.Algorithm)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	object, err := p.findObject(pkcs11.CKO_PRIVATE_KEY, secret.Value)
+	if err != nil {
+		return nil, err
+	}
+	err = p.module.SignInit(p.session, []*pkcs11.Mechanism{mechanism}, object)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.module.Sign(p.session, data)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(secret.Algorithm, "ES") {
+		half := len(signature) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			R: new(big.Int).SetBytes(signature[:half]),
+			S: new(big.Int).SetBytes(signature[half:]),
+		})
+	}
+	return signature, nil
+}
+
+// DestroyKey removes both halves of the key pair from the token.
+func (p *PKCS11KeyCustody) DestroyKey(_ context.Context, secret *models.SecretModel) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		object, err := p.findObject(class, secret.Value)
+		if err != nil {
+			return err
+		}
+		err = p.module.DestroyObject(p.session, object)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PKCS11KeyCustody) findObject(class uint, handle []byte) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, handle),
+	}
+	err := p.module.FindObjectsInit(p.session, template)
+	if err != nil {
+		return 0, err
+	}
+	objects, _, err := p.module.FindObjects(p.session, 1)
+	finalErr := p.module.FindObjectsFinal(p.session)
+	if err != nil {
+		return 0, err
+	}
+	if finalErr != nil {
+		return 0, finalErr
+	}
+	if len(objects) < 1 {
+		return 0, fmt.Errorf("key not found with handle %s", handle)
+	}
+	return objects[0], nil
+}
+
+// bytesToUint decodes a CK_ULONG attribute, which the module returns in the native little endian
+// byte order.
+func bytesToUint(value []byte) uint {
+	var result uint
+	for i := len(value) - 1; i >= 0; i-- {
+		result = result<<8 | uint(value[i])
+	}
+	return result
+}
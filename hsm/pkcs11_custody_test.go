@@ -0,0 +1,68 @@
+package hsm
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"github.com/google/uuid"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// The test runs against SoftHSM, initialize a token and export its module path, e.g.
+//
+//	softhsm2-util --init-token --free --label cerberus --pin 1234 --so-pin 1234
+//	PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_TOKEN=cerberus PKCS11_PIN=1234 go test ./hsm
+func TestPKCS11KeyCustody(t *testing.T) {
+	modulePath := os.Getenv("PKCS11_MODULE")
+	if modulePath == "" {
+		t.Skip("PKCS11_MODULE not set")
+	}
+	custody, err := NewPKCS11KeyCustody(modulePath, os.Getenv("PKCS11_TOKEN"), os.Getenv("PKCS11_PIN"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer custody.Close()
+	ctx := context.Background()
+	digest := sha256.Sum256([]byte("payload"))
+	for _, alg := range []string{"RS256", "PS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			secret := &models.SecretModel{KeyId: uuid.New().String(), Algorithm: alg, Use: "sig"}
+			err := custody.GenerateKey(ctx, secret)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, secret.KeyId, string(secret.Value))
+			publicKey, err := custody.PublicKey(ctx, secret)
+			if !assert.NoError(t, err) {
+				return
+			}
+			var opts crypto.SignerOpts = crypto.SHA256
+			if alg == "PS256" {
+				opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			}
+			signature, err := custody.Sign(ctx, secret, digest[:], opts)
+			if !assert.NoError(t, err) {
+				return
+			}
+			switch key := publicKey.(type) {
+			case *rsa.PublicKey:
+				if alg == "PS256" {
+					assert.NoError(t, rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, opts.(*rsa.PSSOptions)))
+				} else {
+					assert.NoError(t, rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature))
+				}
+			case *ecdsa.PublicKey:
+				assert.True(t, ecdsa.VerifyASN1(key, digest[:], signature))
+			}
+			if assert.NoError(t, custody.DestroyKey(ctx, secret)) {
+				_, err = custody.PublicKey(ctx, secret)
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package core
 
 import (
 	"context"
+	"crypto"
 	"github.com/identityOrg/cerberus-core/models"
 	"github.com/identityOrg/oidcsdk"
+	"gopkg.in/square/go-jose.v2"
 	"image"
+	"time"
 )
 
 type (
@@ -24,17 +27,29 @@ type (
 	}
 	IUserCredentialsService interface {
 		SetPassword(ctx context.Context, id uint, password string) error
+		ImportPasswordHash(ctx context.Context, id uint, algorithm string, hash string) error
+		RequirePasswordChange(ctx context.Context, id uint) error
 		GenerateTOTP(ctx context.Context, id uint, issuer string) (img image.Image, secret string, err error)
 		ValidatePassword(ctx context.Context, id uint, password string) (err error)
 		ValidateTOTP(ctx context.Context, id uint, code string) (err error)
+		ConfirmTOTP(ctx context.Context, id uint, name string, code string) (err error)
+		GetTOTPStatus(ctx context.Context, id uint) (*TOTPStatus, error)
+		GenerateRecoveryCodes(ctx context.Context, id uint) (codes []string, err error)
+		ValidateRecoveryCode(ctx context.Context, id uint, code string) (err error)
+		GetRemainingRecoveryCodes(ctx context.Context, id uint) (remaining int, err error)
+		ListCredentials(ctx context.Context, id uint) ([]models.UserCredentials, error)
+		RenameCredential(ctx context.Context, id uint, credId uint, name string) (err error)
+		RemoveCredential(ctx context.Context, id uint, credId uint) (err error)
 	}
 	IUserChangeService interface {
 		ActivateUser(ctx context.Context, id uint) error
 		DeactivateUser(ctx context.Context, id uint) error
 		UsernameAvailable(ctx context.Context, username string) (available bool)
 		ChangeUsername(ctx context.Context, id uint, username string) (err error)
-		InitiateEmailChange(ctx context.Context, id uint, email string) (code string, err error)
+		InitiateEmailChange(ctx context.Context, id uint, email string) (err error)
 		CompleteEmailChange(ctx context.Context, id uint, code string) (err error)
+		InitiatePhoneVerification(ctx context.Context, id uint, phoneNumber string) (err error)
+		CompletePhoneVerification(ctx context.Context, id uint, code string) (err error)
 	}
 	IUserCommonService interface {
 		CreateUser(ctx context.Context, username string, email string, metadata *models.UserMetadata) (id uint, err error)
@@ -43,8 +58,42 @@ type (
 		DeleteUser(ctx context.Context, id uint) (err error)
 	}
 	IUserOTPService interface {
-		GenerateUserOTP(ctx context.Context, id uint, length uint8) (code string, err error)
-		ValidateOTP(ctx context.Context, id uint, code string) (err error)
+		GenerateUserOTP(ctx context.Context, id uint, purpose string, length uint8) (code string, err error)
+		ValidateOTP(ctx context.Context, id uint, purpose string, code string) (err error)
+		DeliverUserOTP(ctx context.Context, id uint, purpose string, channel string) (err error)
+	}
+	IEmailSender interface {
+		SendEmail(ctx context.Context, to string, subject string, body string) error
+	}
+	ISMSSender interface {
+		SendSMS(ctx context.Context, to string, body string) error
+	}
+	INotificationService interface {
+		IPasswordResetNotifier
+		Notify(ctx context.Context, user *models.UserModel, channel string, to string, name string, message *NotificationMessage) error
+		NotifyOTP(ctx context.Context, user *models.UserModel, channel string, to string, purpose string, code string, expiresAt time.Time) error
+	}
+	IEmailVerificationService interface {
+		SendEmailVerification(ctx context.Context, id uint) error
+		VerifyEmail(ctx context.Context, token string) (id uint, err error)
+	}
+	IMagicLinkService interface {
+		SendMagicLink(ctx context.Context, login string, binding string) error
+		VerifyMagicLink(ctx context.Context, token string, binding string) (*AuthenticationResult, error)
+	}
+	IWebAuthnService interface {
+		BeginWebAuthnRegistration(ctx context.Context, id uint) (*WebAuthnCreationOptions, error)
+		FinishWebAuthnRegistration(ctx context.Context, id uint, name string, response *WebAuthnAttestationResponse) (credentialId string, err error)
+		BeginWebAuthnLogin(ctx context.Context, username string) (*WebAuthnRequestOptions, error)
+		FinishWebAuthnLogin(ctx context.Context, response *WebAuthnAssertionResponse) (id uint, err error)
+	}
+	IPasswordResetService interface {
+		InitiatePasswordReset(ctx context.Context, login string) error
+		VerifyPasswordResetToken(ctx context.Context, token string) error
+		CompletePasswordReset(ctx context.Context, token string, password string) error
+	}
+	IPasswordResetNotifier interface {
+		NotifyPasswordReset(ctx context.Context, user *models.UserModel, token string, expiresAt time.Time) error
 	}
 	ISPStoreService interface {
 		ISPCommonService
@@ -83,6 +132,7 @@ type (
 	}
 	ITokenStoreService interface {
 		oidcsdk.ITokenStore
+		RevokeUserTokens(ctx context.Context, username string) error
 	}
 	IScopeClaimStoreService interface {
 		IScopeOperations
@@ -109,6 +159,58 @@ type (
 	ISecretStoreService interface {
 		oidcsdk.ISecretStore
 		ISecretChannelManager
+		ISymmetricSecretStore
+		IRequestObjectDecrypter
+		ISecretImportExport
+		ISecretCertificateManager
+		ISecretRetentionManager
+	}
+	ISecretRetentionManager interface {
+		SetChannelRetention(ctx context.Context, channelId uint, retentionDay uint) error
+		PurgeExpiredSecrets(ctx context.Context) (int, error)
+		GetSecretTombstones(ctx context.Context) ([]*models.SecretTombstoneModel, error)
+	}
+	ISecretCertificateManager interface {
+		ConfigureCertificate(ctx context.Context, channelId uint, mode string, subject string) error
+		GetCertificateRequest(ctx context.Context, keyId string) ([]byte, error)
+		CompleteCertificateRequest(ctx context.Context, keyId string, chain []byte) error
+	}
+	ISecretImportExport interface {
+		ImportSecret(ctx context.Context, channelId uint, keyId string, format string, data []byte, password string, state string) (string, error)
+		ExportSecret(ctx context.Context, keyId string, passphrase string) ([]byte, error)
+	}
+	ISymmetricSecretStore interface {
+		GetSymmetricSecrets(ctx context.Context) (*jose.JSONWebKeySet, error)
+	}
+	IKeyCustody interface {
+		Name() string
+		GenerateKey(ctx context.Context, secret *models.SecretModel) error
+		PublicKey(ctx context.Context, secret *models.SecretModel) (crypto.PublicKey, error)
+		Sign(ctx context.Context, secret *models.SecretModel, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+	}
+	IPasswordHasher interface {
+		Hash(password string) (string, error)
+		Verify(encoded string, password string) (bool, error)
+		NeedsRehash(encoded string) bool
+	}
+	IPasswordPolicy interface {
+		Validate(user *models.UserModel, password string) ([]PasswordViolation, error)
+	}
+	IPasswordPolicyProvider interface {
+		GetPasswordPolicy(ctx context.Context, user *models.UserModel) (IPasswordPolicy, error)
+	}
+	IKeyDestroyer interface {
+		DestroyKey(ctx context.Context, secret *models.SecretModel) error
+	}
+	IRequestObjectDecrypter interface {
+		DecryptRequestObject(ctx context.Context, token string) ([]byte, error)
+	}
+	IJOSEService interface {
+		Sign(ctx context.Context, channelName string, payload []byte, headers map[string]interface{}) (string, error)
+		SignWithAlgorithm(ctx context.Context, algorithm string, payload []byte, headers map[string]interface{}) (string, error)
+		Verify(ctx context.Context, token string) ([]byte, error)
+		Encrypt(ctx context.Context, channelName string, contentEncryption string, payload []byte, headers map[string]interface{}) (string, error)
+		Decrypt(ctx context.Context, token string) ([]byte, error)
 	}
 	ISecretChannelManager interface {
 		CreateChannel(ctx context.Context, name string, algorithm string, use string, validityDay uint) (uint, error)
@@ -122,6 +224,13 @@ type (
 )
 
 const (
-	CredTypePassword = 1
-	CredTypeTOTP     = 2
+	KeyUseSignature  = "sig"
+	KeyUseEncryption = "enc"
+)
+
+const (
+	CredTypePassword      = 1
+	CredTypeTOTP          = 2
+	CredTypeRecoveryCodes = 3
+	CredTypeWebAuthn      = 4
 )
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"gopkg.in/square/go-jose.v2"
+	"time"
+)
+
+// JOSEServiceImpl signs, verifies, encrypts and decrypts with the keys of the secret store, so that
+// the private keys never leave it.
+type JOSEServiceImpl struct {
+	SecretStore *SecretStoreServiceImpl
+}
+
+func NewJOSEServiceImpl(secretStore *SecretStoreServiceImpl) *JOSEServiceImpl {
+	return &JOSEServiceImpl{SecretStore: secretStore}
+}
+
+// Sign produces a compact JWS of the payload with the active key of the channel. The extra headers
+// are added to the protected header, the kid is always the one of the key used.
+func (j *JOSEServiceImpl) Sign(ctx context.Context, channelName string, payload []byte, headers map[string]interface{}) (string, error) {
+	channel, err := j.SecretStore.GetChannelByName(ctx, channelName)
+	if err != nil {
+		return "", err
+	}
+	return j.sign(ctx, channel, payload, headers)
+}
+
+func (j *JOSEServiceImpl) SignWithAlgorithm(ctx context.Context, algorithm string, payload []byte, headers map[string]interface{}) (string, error) {
+	channel, err := j.SecretStore.GetChannelByAlgoUse(ctx, algorithm, KeyUseSignature)
+	if err != nil {
+		return "", err
+	}
+	return j.sign(ctx, channel, payload, headers)
+}
+
+func (j *JOSEServiceImpl) sign(ctx context.Context, channel *models.SecretChannelModel, payload []byte, headers map[string]interface{}) (string, error) {
+	if channel.Use != KeyUseSignature {
+		return "", fmt.Errorf("channel %s is not a signature channel", channel.Name)
+	}
+	secret, err := activeSecret(channel)
+	if err != nil {
+		return "", err
+	}
+	signingKey := jose.SigningKey{Algorithm: jose.SignatureAlgorithm(secret.Algorithm)}
+	if IsSymmetricAlgorithm(secret.Algorithm) {
+		key, err := j.SecretStore.parseSecret(ctx, secret)
+		if err != nil {
+			return "", err
+		}
+		signingKey.Key = key
+	} else {
+		signer, err := j.SecretStore.opaqueSigner(ctx, secret)
+		if err != nil {
+			return "", err
+		}
+		signingKey.Key = signer
+	}
+	options := &jose.SignerOptions{}
+	for name, value := range headers {
+		options.WithHeader(jose.HeaderKey(name), value)
+	}
+	options.WithHeader("kid", secret.KeyId)
+	signer, err := jose.NewSigner(signingKey, options)
+	if err != nil {
+		return "", err
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
+
+// Verify checks the JWS with the key of its kid, active or retired, and returns the payload. The
+// alg of the header must be the algorithm of the key.
+func (j *JOSEServiceImpl) Verify(ctx context.Context, token string) ([]byte, error) {
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, fmt.Errorf("expected one signature, found %d", len(jws.Signatures))
+	}
+	header := jws.Signatures[0].Header
+	secret, err := j.SecretStore.findSecret(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Use != KeyUseSignature || secret.Algorithm != header.Algorithm {
+		return nil, fmt.Errorf("secret %s can not verify %s signatures", secret.KeyId, header.Algorithm)
+	}
+	var verificationKey interface{}
+	if IsSymmetricAlgorithm(secret.Algorithm) {
+		verificationKey, err = j.SecretStore.parseSecret(ctx, secret)
+	} else {
+		verificationKey, err = j.publicKey(ctx, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jws.Verify(verificationKey)
+}
+
+// Encrypt produces a compact JWE of the payload to the active key of the encryption channel.
+func (j *JOSEServiceImpl) Encrypt(ctx context.Context, channelName string, contentEncryption string, payload []byte, headers map[string]interface{}) (string, error) {
+	channel, err := j.SecretStore.GetChannelByName(ctx, channelName)
+	if err != nil {
+		return "", err
+	}
+	if channel.Use != KeyUseEncryption {
+		return "", fmt.Errorf("channel %s is not an encryption channel", channel.Name)
+	}
+	secret, err := activeSecret(channel)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := j.publicKey(ctx, secret)
+	if err != nil {
+		return "", err
+	}
+	recipient := jose.Recipient{
+		Algorithm: jose.KeyAlgorithm(secret.Algorithm),
+		Key:       publicKey,
+		KeyID:     secret.KeyId,
+	}
+	options := &jose.EncrypterOptions{}
+	for name, value := range headers {
+		options.WithHeader(jose.HeaderKey(name), value)
+	}
+	encrypter, err := jose.NewEncrypter(jose.ContentEncryption(contentEncryption), recipient, options)
+	if err != nil {
+		return "", err
+	}
+	jwe, err := encrypter.Encrypt(payload)
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+
+func (j *JOSEServiceImpl) Decrypt(ctx context.Context, token string) ([]byte, error) {
+	return j.SecretStore.DecryptRequestObject(ctx, token)
+}
+
+func (j *JOSEServiceImpl) publicKey(ctx context.Context, secret *models.SecretModel) (crypto.PublicKey, error) {
+	custody, err := j.SecretStore.custodyOf(secret)
+	if err != nil {
+		return nil, err
+	}
+	return custody.PublicKey(ctx, secret)
+}
+
+// activeSecret returns the key of the channel expiring last, provided it has not expired yet.
+func activeSecret(channel *models.SecretChannelModel) (*models.SecretModel, error) {
+	var active *models.SecretModel
+	for _, secret := range channel.Secrets {
+		if active == nil || secret.ExpiresAt.After(active.ExpiresAt) {
+			active = secret
+		}
+	}
+	if active == nil || !active.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("no active key in channel %s", channel.Name)
+	}
+	return active, nil
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"testing"
+)
+
+func TestJOSEServiceImpl(t *testing.T) {
+	enc := NewNoOpTextEncrypt()
+	secretService := NewSecretStoreServiceImpl(TestDb, enc, enc)
+	ctx := context.Background()
+	secretService.Db = beginTransaction(ctx, secretService.Db)
+	joseService := NewJOSEServiceImpl(secretService)
+	for _, alg := range []string{"RS256", "PS256", "ES256", "HS256"} {
+		t.Run("sign and verify "+alg, func(t *testing.T) {
+			channelId, err := secretService.CreateChannel(ctx, "jose-"+alg, alg, "sig", 10)
+			if !assert.NoError(t, err) {
+				return
+			}
+			token, err := joseService.Sign(ctx, "jose-"+alg, []byte("payload"), map[string]interface{}{"typ": "JWT"})
+			if !assert.NoError(t, err) {
+				return
+			}
+			jws, err := jose.ParseSigned(token)
+			if assert.NoError(t, err) {
+				channel, _ := secretService.GetChannel(ctx, channelId)
+				assert.Equal(t, channel.Secrets[0].KeyId, jws.Signatures[0].Header.KeyID)
+				assert.Equal(t, "JWT", jws.Signatures[0].Header.ExtraHeaders["typ"])
+			}
+			payload, err := joseService.Verify(ctx, token)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "payload", string(payload))
+			}
+			err = secretService.RenewSecret(ctx, channelId)
+			if assert.NoError(t, err) {
+				_, err = joseService.Verify(ctx, token)
+				assert.NoError(t, err, "retired key must verify")
+				renewed, err := joseService.SignWithAlgorithm(ctx, alg, []byte("payload"), nil)
+				if assert.NoError(t, err) {
+					jws, _ := jose.ParseSigned(renewed)
+					channel, _ := secretService.GetChannel(ctx, channelId)
+					assert.Equal(t, channel.Secrets[1].KeyId, jws.Signatures[0].Header.KeyID)
+				}
+			}
+		})
+	}
+	t.Run("encrypt and decrypt", func(t *testing.T) {
+		_, err := secretService.CreateChannel(ctx, "jose-enc", "RSA-OAEP-256", "enc", 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = joseService.Sign(ctx, "jose-enc", []byte("payload"), nil)
+		assert.Error(t, err)
+		token, err := joseService.Encrypt(ctx, "jose-enc", "A256GCM", []byte("secret payload"), nil)
+		if assert.NoError(t, err) {
+			payload, err := joseService.Decrypt(ctx, token)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "secret payload", string(payload))
+			}
+		}
+	})
+	rollbackTransaction(secretService.Db)
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMagicLinkTTL            = 15 * time.Minute
+	defaultMagicLinkResendInterval = time.Minute
+	defaultMagicLinkMaxSends       = 5
+	AMREmail                       = "email"
+)
+
+var ErrInvalidLoginToken = errors.New("invalid or expired login token")
+
+// AuthenticationResult tells which user an authentication method identified, and the methods used
+// as amr values.
+type AuthenticationResult struct {
+	UserID   uint      `json:"user_id"`
+	AMR      []string  `json:"amr"`
+	AuthTime time.Time `json:"auth_time"`
+}
+
+// MagicLinkServiceImpl signs users in with a link sent to their email address. Login tokens are
+// random, stored hashed, expire after Config.MagicLinkTTL and can be used once. A token can be bound
+// to the browser that asked for it, with a session nonce that has to come back with the token.
+// Sending a link revokes the previous one, and is limited like an email verification to one send
+// per Config.MagicLinkResendInterval and Config.MagicLinkMaxSends sends a day.
+type MagicLinkServiceImpl struct {
+	Db         *gorm.DB
+	Config     *Config
+	Notifier   INotificationService
+	deliveries sync.WaitGroup
+}
+
+func NewMagicLinkServiceImpl(db *gorm.DB, config *Config, notifier INotificationService) *MagicLinkServiceImpl {
+	return &MagicLinkServiceImpl{Db: db, Config: config, Notifier: notifier}
+}
+
+// SendMagicLink emails a login link to the active user with the username or email. Like a password
+// reset it succeeds alike when no such user exists: the link is delivered in the background, and a
+// failed delivery or a send over the rate limit is only logged. A non empty binding is required to
+// verify the token. An error is returned when the store fails.
+func (m *MagicLinkServiceImpl) SendMagicLink(ctx context.Context, login string, binding string) error {
+	if login == "" {
+		return nil
+	}
+	db := m.Db.WithContext(ctx)
+	user := &models.UserModel{}
+	result := db.Where("inactive = ? and email_address <> ?", false, "").
+		Where(db.Where("username = ?", login).Or("email_address = ?", login)).Limit(1).Find(user)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil
+	}
+	random, err := GenerateRandomBytes(resetTokenLength)
+	if err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	ttl := m.Config.MagicLinkTTL
+	if ttl <= 0 {
+		ttl = defaultMagicLinkTTL
+	}
+	now := time.Now()
+	loginToken := &models.UserLoginToken{
+		UserID:      user.ID,
+		TokenHash:   hashResetToken(token),
+		ExpiresAt:   now.Add(ttl),
+		WindowStart: now,
+	}
+	if binding != "" {
+		loginToken.BindingHash = hashResetToken(binding)
+	}
+	message := newNotificationMessage(token, loginToken.ExpiresAt)
+	if message.Link, err = tokenLink(m.Config.MagicLinkURL, token); err != nil {
+		return err
+	}
+	allowed := true
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var previous []models.UserLoginToken
+		if err := tx.Order("last_sent_at").Find(&previous, "user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+		if len(previous) > 0 {
+			// the send counter carries over from the latest link
+			last := previous[len(previous)-1]
+			loginToken.WindowStart, loginToken.SendCount = last.WindowStart, last.SendCount
+			allowed = sendAllowed(last.LastSentAt, &loginToken.WindowStart, &loginToken.SendCount,
+				m.resendInterval(), m.maxSends(), now)
+			if !allowed {
+				return nil
+			}
+		}
+		deleted := tx.Delete(&models.UserLoginToken{}, "user_id = ?", user.ID)
+		if deleted.Error != nil {
+			return deleted.Error
+		}
+		if deleted.RowsAffected != int64(len(previous)) {
+			// a concurrent send replaced the links, it counts as this one
+			allowed = false
+			return nil
+		}
+		loginToken.LastSentAt = now
+		loginToken.SendCount++
+		return tx.Create(loginToken).Error
+	})
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.Printf("login link to user %d not sent, rate limited", user.ID)
+		return nil
+	}
+	deliverInBackground(&m.deliveries, "login link", user.ID, func(ctx context.Context) error {
+		return m.Notifier.Notify(ctx, user, NotificationChannelEmail, user.EmailAddress, TemplateMagicLink, message)
+	})
+	return nil
+}
+
+func (m *MagicLinkServiceImpl) resendInterval() time.Duration {
+	if m.Config.MagicLinkResendInterval <= 0 {
+		return defaultMagicLinkResendInterval
+	}
+	return m.Config.MagicLinkResendInterval
+}
+
+func (m *MagicLinkServiceImpl) maxSends() uint {
+	if m.Config.MagicLinkMaxSends == 0 {
+		return defaultMagicLinkMaxSends
+	}
+	return m.Config.MagicLinkMaxSends
+}
+
+// VerifyMagicLink uses the token and returns the user it signs in. A token with a binding is only
+// accepted with the same binding, a mismatch leaves the token for the browser it was issued to. An
+// inactive user or a blocked password fail the login, a magic link does not get around a lockout.
+func (m *MagicLinkServiceImpl) VerifyMagicLink(ctx context.Context, token string, binding string) (*AuthenticationResult, error) {
+	db := m.Db.WithContext(ctx)
+	loginToken := &models.UserLoginToken{}
+	result := db.Find(loginToken, "token_hash = ? and expires_at > ?", hashResetToken(token), time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrInvalidLoginToken
+	}
+	if loginToken.BindingHash != "" &&
+		subtle.ConstantTimeCompare([]byte(loginToken.BindingHash), []byte(hashResetToken(binding))) != 1 {
+		return nil, ErrInvalidLoginToken
+	}
+	deleted := db.Delete(loginToken)
+	if deleted.Error != nil {
+		return nil, deleted.Error
+	}
+	if deleted.RowsAffected != 1 {
+		// verified concurrently, the token is already used
+		return nil, ErrInvalidLoginToken
+	}
+	user := &models.UserModel{}
+	user.ID = loginToken.UserID
+	result = db.Find(user)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrInvalidLoginToken
+	}
+	if user.Inactive {
+		return nil, errors.New("user inactive")
+	}
+	var blocked int64
+	err := db.Model(&models.UserCredentials{}).
+		Where("user_id = ? and cred_type = ? and blocked = ?", user.ID, CredTypePassword, true).Count(&blocked).Error
+	if err != nil {
+		return nil, err
+	}
+	if blocked > 0 {
+		return nil, errors.New("credential blocked")
+	}
+	return &AuthenticationResult{UserID: user.ID, AMR: []string{AMREmail}, AuthTime: time.Now()}, nil
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMagicLinkServiceImpl(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{MagicLinkURL: "https://localhost:8080/login/link", MagicLinkMaxSends: 2}
+	notifier, output := newBufferNotifier(config)
+	magicLink := NewMagicLinkServiceImpl(beginTransaction(ctx, TestDb), config, notifier)
+	tokenPattern := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+	t.Run("unknown account", func(t *testing.T) {
+		assert.NoError(t, magicLink.SendMagicLink(ctx, "nobody@domain.com", ""))
+		assert.Empty(t, output.String())
+	})
+	t.Run("bound to the browser", func(t *testing.T) {
+		if !assert.NoError(t, magicLink.SendMagicLink(ctx, TestUser.EmailAddress, "nonce")) {
+			return
+		}
+		magicLink.deliveries.Wait()
+		assert.Contains(t, output.String(), "To: user@domain.com")
+		token := tokenPattern.FindStringSubmatch(output.String())[1]
+		_, err := magicLink.VerifyMagicLink(ctx, token, "other nonce")
+		assert.Equal(t, ErrInvalidLoginToken, err)
+		result, err := magicLink.VerifyMagicLink(ctx, token, "nonce")
+		if assert.NoError(t, err) {
+			assert.Equal(t, TestUser.ID, result.UserID)
+			assert.Equal(t, []string{"email"}, result.AMR)
+		}
+		_, err = magicLink.VerifyMagicLink(ctx, token, "nonce")
+		assert.Equal(t, ErrInvalidLoginToken, err, "single use")
+	})
+	t.Run("blocked password", func(t *testing.T) {
+		output.Reset()
+		if !assert.NoError(t, magicLink.SendMagicLink(ctx, TestUser.Username, "")) {
+			return
+		}
+		magicLink.deliveries.Wait()
+		magicLink.Db.Model(&models.UserCredentials{}).Where("user_id = ? and cred_type = ?", TestUser.ID, CredTypePassword).
+			Update("blocked", true)
+		_, err := magicLink.VerifyMagicLink(ctx, tokenPattern.FindStringSubmatch(output.String())[1], "")
+		assert.EqualError(t, err, "credential blocked")
+	})
+	t.Run("rate limited", func(t *testing.T) {
+		id := TestNoCredUser2.ID
+		output.Reset()
+		if !assert.NoError(t, magicLink.SendMagicLink(ctx, TestNoCredUser2.Username, "")) {
+			return
+		}
+		magicLink.deliveries.Wait()
+		first := tokenPattern.FindStringSubmatch(output.String())[1]
+		output.Reset()
+		assert.NoError(t, magicLink.SendMagicLink(ctx, TestNoCredUser2.Username, ""), "too soon, not reported")
+		magicLink.deliveries.Wait()
+		assert.Empty(t, output.String())
+		magicLink.Db.Model(&models.UserLoginToken{}).Where("user_id = ?", id).
+			Update("last_sent_at", time.Now().Add(-time.Hour))
+		assert.NoError(t, magicLink.SendMagicLink(ctx, TestNoCredUser2.Username, ""))
+		magicLink.deliveries.Wait()
+		assert.Contains(t, output.String(), "To: "+TestNoCredUser2.EmailAddress)
+		_, err := magicLink.VerifyMagicLink(ctx, first, "")
+		assert.Equal(t, ErrInvalidLoginToken, err, "earlier link revoked")
+		var count int64
+		magicLink.Db.Model(&models.UserLoginToken{}).Where("user_id = ?", id).Count(&count)
+		assert.Equal(t, int64(1), count)
+		output.Reset()
+		magicLink.Db.Model(&models.UserLoginToken{}).Where("user_id = ?", id).
+			Update("last_sent_at", time.Now().Add(-time.Hour))
+		assert.NoError(t, magicLink.SendMagicLink(ctx, TestNoCredUser2.Username, ""))
+		magicLink.deliveries.Wait()
+		assert.Empty(t, output.String(), "max sends")
+	})
+	t.Run("failed delivery", func(t *testing.T) {
+		email := notifier.Email
+		notifier.Email = nil
+		defer func() { notifier.Email = email }()
+		assert.NoError(t, magicLink.SendMagicLink(ctx, TestNoCredUser.Username, ""))
+		magicLink.deliveries.Wait()
+	})
+	rollbackTransaction(magicLink.Db)
+}
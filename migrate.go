@@ -46,7 +46,7 @@ func SetupDemoData(ormDB *gorm.DB, config *Config, sdkConfig *oidcsdk.Config, re
 	}
 	fmt.Println("Creating demo user with username=user and password=user")
 
-	userService := NewUserStoreServiceImpl(ormDB, config)
+	userService := NewUserStoreServiceImpl(ormDB, config, enc, enc, nil)
 	metadata := &models.UserMetadata{}
 	metadata.SetName("Demo User")
 	metadata.SetEmail("user@demo.com")
@@ -75,7 +75,7 @@ func SetupDemoData(ormDB *gorm.DB, config *Config, sdkConfig *oidcsdk.Config, re
 		return err
 	}
 	fmt.Println("Creating default secret key")
-	secretStore := NewSecretStoreServiceImpl(ormDB)
+	secretStore := NewSecretStoreServiceImpl(ormDB, enc, enc)
 	_, err = secretStore.GetChannelByAlgoUse(nil, "RS256", "sig")
 	if err != nil {
 		_, err = secretStore.CreateChannel(nil, "default", "RS256", "sig", 30)
@@ -83,6 +83,15 @@ func SetupDemoData(ormDB *gorm.DB, config *Config, sdkConfig *oidcsdk.Config, re
 	return err
 }
 
+// EncryptExistingSecrets envelope encrypts the secrets created before the key material was
+// encrypted at rest.
+func EncryptExistingSecrets(ormDB *gorm.DB, dec ITextDecrypts, enc ITextEncrypts) error {
+	secretStore := NewSecretStoreServiceImpl(ormDB, dec, enc)
+	count, err := secretStore.EncryptSecrets(context.Background())
+	fmt.Printf("Encrypted %d secrets\n", count)
+	return err
+}
+
 func SetupDBStructure(ormDB *gorm.DB, drop bool, force bool) error {
 	if drop && !force {
 		fmt.Printf("Do you want to continue (Y/n): ")
@@ -105,14 +114,22 @@ func SetupDBStructure(ormDB *gorm.DB, drop bool, force bool) error {
 	claimT := &models.ClaimModel{}
 	channelT := &models.SecretChannelModel{}
 	secretT := &models.SecretModel{}
+	tombstoneT := &models.SecretTombstoneModel{}
 	userT := &models.UserModel{}
 	credentialsT := &models.UserCredentials{}
+	historyT := &models.UserPasswordHistory{}
+	resetT := &models.UserResetToken{}
 	otpT := &models.UserOTP{}
+	enrollmentT := &models.UserTOTPEnrollment{}
+	recoveryT := &models.UserRecoveryCode{}
+	challengeT := &models.UserWebAuthnChallenge{}
+	emailVerificationT := &models.UserEmailVerification{}
+	loginTokenT := &models.UserLoginToken{}
 	spT := &models.ServiceProviderModel{}
 	tokensT := &models.TokensModel{}
 	jtiT := &models.JTIModel{}
 
-	tables := []dbTable{scopeT, claimT, channelT, secretT, userT, credentialsT, otpT, spT, tokensT, jtiT}
+	tables := []dbTable{scopeT, claimT, channelT, secretT, tombstoneT, userT, credentialsT, historyT, resetT, otpT, enrollmentT, recoveryT, challengeT, emailVerificationT, loginTokenT, spT, tokensT, jtiT}
 
 	fmt.Println("dropping all tables")
 	if drop {
@@ -124,6 +141,10 @@ func SetupDBStructure(ormDB *gorm.DB, drop bool, force bool) error {
 		}
 	}
 
+	if err := migrateCredentialIds(ormDB); err != nil {
+		return fmt.Errorf("error migrating credential ids:%v", err)
+	}
+
 	fmt.Println("creating all tables")
 	for _, table := range tables {
 		var err error
@@ -139,6 +160,29 @@ func SetupDBStructure(ormDB *gorm.DB, drop bool, force bool) error {
 	return InitializeDefaultScope(ormDB)
 }
 
+// migrateCredentialIds moves the credentials table off the empty credential id of the credentials
+// that have none, which needed a partial unique index MySQL does not support. The column becomes
+// nullable and the empty ids NULL, AutoMigrate then creates the plain unique index.
+func migrateCredentialIds(ormDB *gorm.DB) error {
+	migrator := ormDB.Migrator()
+	credentials := &models.UserCredentials{}
+	if !migrator.HasTable(credentials) || !migrator.HasIndex(credentials, "idx_cred_credential_id") {
+		return nil
+	}
+	for _, index := range []string{"uk_cred_type_credential_id", "idx_cred_credential_id"} {
+		if migrator.HasIndex(credentials, index) {
+			if err := migrator.DropIndex(credentials, index); err != nil {
+				return err
+			}
+		}
+	}
+	if err := migrator.AlterColumn(credentials, "CredentialID"); err != nil {
+		return err
+	}
+	return ormDB.Model(credentials).Where("credential_id = ?", "").
+		UpdateColumn("credential_id", gorm.Expr("NULL")).Error
+}
+
 type dbTable interface {
 	TableName() string
 }
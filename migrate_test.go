@@ -1,6 +1,7 @@
 package core
 
 import (
+	"github.com/identityOrg/cerberus-core/models"
 	"github.com/identityOrg/oidcsdk"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
@@ -32,3 +33,45 @@ func TestMigrateDB(t *testing.T) {
 		}
 	}
 }
+
+// legacyCredentials is the credentials table as it was with an empty credential id.
+type legacyCredentials struct {
+	ID           uint   `gorm:"column:id;primary_key"`
+	UserID       uint   `gorm:"column:user_id;not null;index:uk_user_cred_type_id,unique"`
+	Type         uint8  `gorm:"column:cred_type;auto_increment:false;index:uk_user_cred_type_id,unique;index:uk_cred_type_credential_id,unique,where:credential_id <> ''"`
+	CredentialID string `gorm:"column:credential_id;size:512;not null;default:'';index:uk_user_cred_type_id,unique;index:idx_cred_credential_id;index:uk_cred_type_credential_id,unique,where:credential_id <> ''"`
+}
+
+func (legacyCredentials) TableName() string {
+	return "t_user_credentials"
+}
+
+func TestMigrateCredentialIds(t *testing.T) {
+	_ = os.Remove("migrate.db")
+	db, err := gorm.Open(sqlite.Open("migrate.db"), &gorm.Config{})
+	if !assert.NoError(t, err) || !assert.NoError(t, db.AutoMigrate(&legacyCredentials{})) {
+		return
+	}
+	legacy := []legacyCredentials{
+		{UserID: 1, Type: CredTypePassword},
+		{UserID: 2, Type: CredTypePassword},
+		{UserID: 1, Type: CredTypeWebAuthn, CredentialID: "webauthn-id"},
+	}
+	if !assert.NoError(t, db.Create(&legacy).Error) {
+		return
+	}
+	if !assert.NoError(t, migrateCredentialIds(db)) || !assert.NoError(t, models.UserCredentials{}.AutoMigrate(db.Migrator())) {
+		return
+	}
+	migrator := db.Migrator()
+	assert.False(t, migrator.HasIndex(&models.UserCredentials{}, "idx_cred_credential_id"))
+	assert.True(t, migrator.HasIndex(&models.UserCredentials{}, "uk_cred_type_credential_id"))
+	var count int64
+	db.Model(&models.UserCredentials{}).Where("credential_id is null").Count(&count)
+	assert.Equal(t, int64(2), count)
+	credentialId := "webauthn-id"
+	duplicate := &models.UserCredentials{UserID: 2, Type: CredTypeWebAuthn, CredentialID: &credentialId}
+	assert.Error(t, db.Create(duplicate).Error)
+	assert.NoError(t, db.Create(&models.UserCredentials{UserID: 3, Type: CredTypePassword}).Error)
+	assert.NoError(t, migrateCredentialIds(db), "runs once")
+}
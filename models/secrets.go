@@ -1,17 +1,24 @@
 package models
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"gorm.io/gorm"
 	"time"
 )
 
 type SecretChannelModel struct {
 	BaseModel
-	Name        string         `gorm:"column:name;index:idx_channel_name,unique" json:"name"`
-	Algorithm   string         `gorm:"column:algorithm;index:idx_alg_use,unique" json:"algorithm"`
-	Use         string         `gorm:"column:key_usage;index:idx_alg_use,unique" json:"use"`
-	ValidityDay uint           `gorm:"column:validity_day" json:"validity_day"`
-	Secrets     []*SecretModel `gorm:"foreignKey:ChannelId" json:"secrets"`
+	Name        string `gorm:"column:name;index:idx_channel_name,unique" json:"name"`
+	Algorithm   string `gorm:"column:algorithm;index:idx_alg_use,unique" json:"algorithm"`
+	Use         string `gorm:"column:key_usage;index:idx_alg_use,unique" json:"use"`
+	ValidityDay uint   `gorm:"column:validity_day" json:"validity_day"`
+	// RetentionDay is the number of days a key is kept after it expires, zero purges it right away.
+	// Unset, it is kept for ValidityDay.
+	RetentionDay       *uint          `gorm:"column:retention_day" json:"retention_day,omitempty"`
+	CertificateMode    string         `gorm:"column:certificate_mode;size:16" json:"certificate_mode,omitempty"`
+	CertificateSubject string         `gorm:"column:certificate_subject;size:512" json:"certificate_subject,omitempty"`
+	Secrets            []*SecretModel `gorm:"foreignKey:ChannelId" json:"secrets"`
 }
 
 func (sp SecretChannelModel) AutoMigrate(db gorm.Migrator) error {
@@ -22,15 +29,31 @@ func (sp SecretChannelModel) TableName() string {
 	return "t_secret_channel"
 }
 
+func (sp SecretChannelModel) EffectiveRetentionDay() uint {
+	if sp.RetentionDay == nil {
+		return sp.ValidityDay
+	}
+	return *sp.RetentionDay
+}
+
 type SecretModel struct {
 	BaseModel
-	KeyId     string    `gorm:"column:key_id" json:"key_id"`
-	IssuedAt  time.Time `gorm:"column:issued_at" json:"issued_at"`
-	ExpiresAt time.Time `gorm:"column:expires_at" json:"expires_at"`
-	Value     []byte    `gorm:"column:value" json:"-"`
-	ChannelId uint      `gorm:"column:channel_id" json:"channel_id"`
-	Algorithm string    `gorm:"column:algorithm" json:"-"`
-	Use       string    `gorm:"column:key_usage" json:"-"`
+	KeyId      string    `gorm:"column:key_id" json:"key_id"`
+	IssuedAt   time.Time `gorm:"column:issued_at" json:"issued_at"`
+	ExpiresAt  time.Time `gorm:"column:expires_at" json:"expires_at"`
+	Value      []byte    `gorm:"column:value" json:"-"`
+	WrappedKey string    `gorm:"column:wrapped_key;size:1024" json:"-"`
+	ChannelId  uint      `gorm:"column:channel_id" json:"channel_id"`
+	Algorithm  string    `gorm:"column:algorithm" json:"-"`
+	Use        string    `gorm:"column:key_usage" json:"-"`
+	Custody    string    `gorm:"column:custody;size:32" json:"custody,omitempty"`
+	// RetainUntil keeps a key that was imported retired, which expires at once, from being purged
+	// before then whatever the retention of the channel.
+	RetainUntil *time.Time `gorm:"column:retain_until" json:"retain_until,omitempty"`
+	// Certificates holds the PEM encoded certificate chain of the key, the first one certifies the key.
+	Certificates []byte `gorm:"column:certificates" json:"-"`
+	// CertificateRequest holds the PEM encoded CSR of the key, until the issued certificate is stored.
+	CertificateRequest []byte `gorm:"column:certificate_request" json:"-"`
 }
 
 func (sp SecretModel) AutoMigrate(db gorm.Migrator) error {
@@ -40,3 +63,46 @@ func (sp SecretModel) AutoMigrate(db gorm.Migrator) error {
 func (sp SecretModel) TableName() string {
 	return "t_secret"
 }
+
+func (sp *SecretModel) SetCertificateChain(certificates []*x509.Certificate) {
+	sp.Certificates = nil
+	for _, certificate := range certificates {
+		block := &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}
+		sp.Certificates = append(sp.Certificates, pem.EncodeToMemory(block)...)
+	}
+}
+
+func (sp SecretModel) CertificateChain() ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for block, rest := pem.Decode(sp.Certificates); block != nil; block, rest = pem.Decode(rest) {
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// SecretTombstoneModel records a purged key for auditing, the key material is gone.
+type SecretTombstoneModel struct {
+	DeletableBaseModel
+	KeyId       string    `gorm:"column:key_id;index" json:"key_id"`
+	Algorithm   string    `gorm:"column:algorithm" json:"algorithm"`
+	Use         string    `gorm:"column:key_usage" json:"use"`
+	ChannelId   uint      `gorm:"column:channel_id" json:"channel_id"`
+	ChannelName string    `gorm:"column:channel_name" json:"channel_name,omitempty"`
+	IssuedAt    time.Time `gorm:"column:issued_at" json:"issued_at"`
+	ExpiresAt   time.Time `gorm:"column:expires_at" json:"expires_at"`
+	Custody     string    `gorm:"column:custody;size:32" json:"custody,omitempty"`
+	// KeyHandle is the custody reference of a key still to be destroyed there, cleared once it is.
+	KeyHandle []byte `gorm:"column:key_handle" json:"-"`
+}
+
+func (st SecretTombstoneModel) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&st)
+}
+
+func (st SecretTombstoneModel) TableName() string {
+	return "t_secret_tombstone"
+}
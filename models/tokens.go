@@ -14,6 +14,7 @@ type (
 	TokensModel struct {
 		BaseModel
 		RequestID      string         `gorm:"column:request_id;not null" json:"request_id,omitempty"`
+		Username       string         `gorm:"column:username;size:256;index:idx_token_username" json:"username,omitempty"`
 		ACSignature    sql.NullString `gorm:"column:ac_signature;size:512;index:idx_token_ac" json:"ac_signature,omitempty"`
 		ATSignature    sql.NullString `gorm:"column:at_signature;size:512;index:idx_token_at" json:"at_signature,omitempty"`
 		RTSignature    sql.NullString `gorm:"column:rt_signature;size:512;index:idx_token_rt" json:"rt_signature,omitempty"`
@@ -10,6 +10,7 @@ type UserModel struct {
 	Username         string            `gorm:"column:username;index:idx_user_name,unique" json:"username,omitempty"`
 	EmailAddress     string            `gorm:"column:email_address;size:512;index:idx_user_email,unique" json:"email_address,omitempty"`
 	TempEmailAddress string            `gorm:"column:temp_email_address;size:512;" json:"-"`
+	TempPhoneNumber  string            `gorm:"column:temp_phone_number;size:32;" json:"-"`
 	Metadata         *UserMetadata     `gorm:"column:metadata" json:"metadata,omitempty"`
 	Credentials      []UserCredentials `gorm:"foreignKey:UserID" json:"credentials,omitempty"`
 	Inactive         bool              `gorm:"column:inactive" json:"inactive,omitempty"`
@@ -25,15 +26,35 @@ func (um UserModel) TableName() string {
 
 type UserCredentials struct {
 	DeletableBaseModel
-	UserID              uint       `gorm:"column:user_id;not null;index:uk_user_cred_type,unique" json:"-"`
-	Type                uint8      `gorm:"column:cred_type;auto_increment:false;index:uk_user_cred_type,unique" json:"cred_type,omitempty"`
+	UserID              uint       `gorm:"column:user_id;not null;index:uk_user_cred_type_id,unique" json:"-"`
+	Type                uint8      `gorm:"column:cred_type;auto_increment:false;index:uk_user_cred_type_id,unique;index:uk_cred_type_credential_id,unique" json:"cred_type,omitempty"`
+	CredentialID        *string    `gorm:"column:credential_id;size:512;index:uk_user_cred_type_id,unique;index:uk_cred_type_credential_id,unique" json:"credential_id,omitempty"`
+	Name                string     `gorm:"column:name;size:128" json:"name,omitempty"`
 	Value               string     `gorm:"column:value;size:2048" json:"value,omitempty"`
+	Algorithm           string     `gorm:"column:algorithm;size:32" json:"algorithm,omitempty"`
+	ChangedAt           *time.Time `gorm:"column:changed_at" json:"changed_at,omitempty"`
+	MustChange          bool       `gorm:"column:must_change" json:"must_change,omitempty"`
+	Period              uint       `gorm:"column:period" json:"period,omitempty"`
+	Digits              uint8      `gorm:"column:digits" json:"digits,omitempty"`
+	LastTimeStep        uint64     `gorm:"column:last_time_step" json:"-"`
+	PublicKey           []byte     `gorm:"column:public_key" json:"-"`
+	SignCount           uint32     `gorm:"column:sign_count" json:"sign_count,omitempty"`
+	AAGUID              []byte     `gorm:"column:aaguid;size:16" json:"aaguid,omitempty"`
+	Transports          string     `gorm:"column:transports;size:256" json:"transports,omitempty"`
 	FirstInvalidAttempt *time.Time `gorm:"column:first_invalid_attempt" json:"first_invalid_attempt,omitempty"`
 	InvalidAttemptCount uint       `gorm:"column:invalid_attempt_count" json:"invalid_attempt_count,omitempty"`
 	Bocked              bool       `gorm:"column:blocked" json:"bocked,omitempty"`
 }
 
+// AutoMigrate drops the former unique index on user and type. A user can hold several credentials of
+// a type, told apart by their credential id, the password and recovery codes have none. A credential
+// id is unique within its type across all users.
 func (uc UserCredentials) AutoMigrate(db gorm.Migrator) error {
+	if db.HasIndex(&uc, "uk_user_cred_type") {
+		if err := db.DropIndex(&uc, "uk_user_cred_type"); err != nil {
+			return err
+		}
+	}
 	return db.AutoMigrate(&uc)
 }
 
@@ -41,15 +62,149 @@ func (uc UserCredentials) TableName() string {
 	return "t_user_credentials"
 }
 
-type UserOTP struct {
+type UserPasswordHistory struct {
+	ID        uint      `gorm:"column:id;primary_key" json:"id,omitempty"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at,omitempty"`
+	UserID    uint      `gorm:"column:user_id;not null;index" json:"-"`
+	Value     string    `gorm:"column:value;size:2048" json:"-"`
+	Algorithm string    `gorm:"column:algorithm;size:32" json:"algorithm,omitempty"`
+}
+
+func (h UserPasswordHistory) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&h)
+}
+
+func (h UserPasswordHistory) TableName() string {
+	return "t_user_password_history"
+}
+
+type UserResetToken struct {
 	ID        uint       `gorm:"column:id;primary_key" json:"id,omitempty"`
 	CreatedAt time.Time  `gorm:"column:created_at" json:"created_at,omitempty"`
-	DeletedAt *time.Time `gorm:"column:deleted_at;index" json:"deleted_at,omitempty"`
-	ValueHash string     `gorm:"column:hash_value;index" json:"value_hash,omitempty"`
-	UserID    uint       `gorm:"column:user_id;index:uk_user_otp_id,unique" json:"user_id"`
+	UserID    uint       `gorm:"column:user_id;not null;index" json:"user_id"`
+	TokenHash string     `gorm:"column:token_hash;size:64;index:uk_reset_token_hash,unique" json:"-"`
+	ExpiresAt time.Time  `gorm:"column:expires_at" json:"expires_at"`
+	UsedAt    *time.Time `gorm:"column:used_at" json:"used_at,omitempty"`
+}
+
+func (r UserResetToken) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&r)
+}
+
+func (r UserResetToken) TableName() string {
+	return "t_user_reset_token"
+}
+
+type UserEmailVerification struct {
+	ID          uint      `gorm:"column:id;primary_key" json:"id,omitempty"`
+	CreatedAt   time.Time `gorm:"column:created_at" json:"created_at,omitempty"`
+	UserID      uint      `gorm:"column:user_id;not null;index:uk_email_verification_user,unique" json:"user_id"`
+	Email       string    `gorm:"column:email;size:512" json:"email"`
+	TokenHash   string    `gorm:"column:token_hash;size:64;index:uk_email_verification_token,unique" json:"-"`
+	ExpiresAt   time.Time `gorm:"column:expires_at" json:"expires_at"`
+	LastSentAt  time.Time `gorm:"column:last_sent_at" json:"last_sent_at"`
+	WindowStart time.Time `gorm:"column:window_start" json:"-"`
+	SendCount   uint      `gorm:"column:send_count" json:"send_count"`
+}
+
+func (v UserEmailVerification) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&v)
+}
+
+func (v UserEmailVerification) TableName() string {
+	return "t_user_email_verification"
+}
+
+type UserLoginToken struct {
+	ID          uint      `gorm:"column:id;primary_key" json:"id,omitempty"`
+	CreatedAt   time.Time `gorm:"column:created_at" json:"created_at,omitempty"`
+	UserID      uint      `gorm:"column:user_id;not null;index" json:"user_id"`
+	TokenHash   string    `gorm:"column:token_hash;size:64;index:uk_login_token_hash,unique" json:"-"`
+	BindingHash string    `gorm:"column:binding_hash;size:64" json:"-"`
+	ExpiresAt   time.Time `gorm:"column:expires_at" json:"expires_at"`
+	LastSentAt  time.Time `gorm:"column:last_sent_at" json:"last_sent_at"`
+	WindowStart time.Time `gorm:"column:window_start" json:"-"`
+	SendCount   uint      `gorm:"column:send_count" json:"send_count"`
+}
+
+func (l UserLoginToken) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&l)
+}
+
+func (l UserLoginToken) TableName() string {
+	return "t_user_login_token"
+}
+
+type UserTOTPEnrollment struct {
+	ID        uint      `gorm:"column:id;primary_key" json:"id,omitempty"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at,omitempty"`
+	UserID    uint      `gorm:"column:user_id;not null;index:uk_totp_enrollment_user,unique" json:"user_id"`
+	Secret    string    `gorm:"column:secret;size:2048" json:"-"`
+	Algorithm string    `gorm:"column:algorithm;size:32" json:"algorithm"`
+	Period    uint      `gorm:"column:period" json:"period"`
+	Digits    uint8     `gorm:"column:digits" json:"digits"`
+	ExpiresAt time.Time `gorm:"column:expires_at" json:"expires_at"`
+	Attempts  uint      `gorm:"column:attempts" json:"attempts,omitempty"`
 }
 
+func (e UserTOTPEnrollment) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&e)
+}
+
+func (e UserTOTPEnrollment) TableName() string {
+	return "t_user_totp_enrollment"
+}
+
+type UserRecoveryCode struct {
+	ID        uint       `gorm:"column:id;primary_key" json:"id,omitempty"`
+	CreatedAt time.Time  `gorm:"column:created_at" json:"created_at,omitempty"`
+	UserID    uint       `gorm:"column:user_id;not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"column:code_hash;size:64;index" json:"-"`
+	UsedAt    *time.Time `gorm:"column:used_at" json:"used_at,omitempty"`
+}
+
+func (r UserRecoveryCode) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&r)
+}
+
+func (r UserRecoveryCode) TableName() string {
+	return "t_user_recovery_code"
+}
+
+type UserWebAuthnChallenge struct {
+	ID        uint      `gorm:"column:id;primary_key" json:"id,omitempty"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at,omitempty"`
+	UserID    uint      `gorm:"column:user_id;index" json:"user_id,omitempty"`
+	Challenge string    `gorm:"column:challenge;size:128;index:uk_webauthn_challenge,unique" json:"challenge"`
+	Ceremony  string    `gorm:"column:ceremony;size:16" json:"ceremony"`
+	ExpiresAt time.Time `gorm:"column:expires_at" json:"expires_at"`
+}
+
+func (c UserWebAuthnChallenge) AutoMigrate(db gorm.Migrator) error {
+	return db.AutoMigrate(&c)
+}
+
+func (c UserWebAuthnChallenge) TableName() string {
+	return "t_user_webauthn_challenge"
+}
+
+type UserOTP struct {
+	ID        uint      `gorm:"column:id;primary_key" json:"id,omitempty"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at,omitempty"`
+	ValueHash string    `gorm:"column:hash_value;size:64" json:"-"`
+	UserID    uint      `gorm:"column:user_id;index:uk_user_otp_purpose,unique" json:"user_id"`
+	Purpose   string    `gorm:"column:purpose;size:32;index:uk_user_otp_purpose,unique" json:"purpose"`
+	ExpiresAt time.Time `gorm:"column:expires_at" json:"expires_at"`
+	Attempts  uint      `gorm:"column:attempts" json:"attempts,omitempty"`
+}
+
+// AutoMigrate drops the former unique index on the user, a user holds a code per purpose.
 func (o UserOTP) AutoMigrate(db gorm.Migrator) error {
+	if db.HasIndex(&o, "uk_user_otp_id") {
+		if err := db.DropIndex(&o, "uk_user_otp_id"); err != nil {
+			return err
+		}
+	}
 	return db.AutoMigrate(&o)
 }
 
@@ -57,6 +212,15 @@ func (o UserOTP) TableName() string {
 	return "t_user_otp"
 }
 
+// Age returns how long ago the credential was set, credentials set before the change was tracked
+// are aged from their creation.
+func (uc *UserCredentials) Age() time.Duration {
+	if uc.ChangedAt != nil {
+		return time.Since(*uc.ChangedAt)
+	}
+	return time.Since(uc.CreatedAt)
+}
+
 func (uc *UserCredentials) IncrementInvalidAttempt(maxAllowed uint, window time.Duration) (blocked bool) {
 	if uc.Bocked || maxAllowed < 0 {
 		return uc.Bocked
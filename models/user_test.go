@@ -29,7 +29,9 @@ func TestUserCredentials_Migrate(t *testing.T) {
 		EmailAddress: uuid.New().String(),
 		Credentials:  []UserCredentials{credential},
 	}
-	println(db.AutoMigrate(model, &credential).Error)
+	if err = db.AutoMigrate(model, &credential); err != nil {
+		t.Error(err)
+	}
 
 	db.Save(model)
 
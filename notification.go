@@ -0,0 +1,290 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"io"
+	"mime"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	NotificationChannelEmail = "email"
+	NotificationChannelSMS   = "sms"
+)
+
+// ErrNoNotificationSender is returned when no sender is configured for the channel.
+var ErrNoNotificationSender = errors.New("no notification sender configured")
+
+const (
+	TemplatePasswordReset = "password-reset"
+	TemplateEmailVerify   = "email-verify"
+	TemplateMagicLink     = "magic-link"
+	defaultTemplateLocale = "en"
+)
+
+// NotificationMessage is the data the message templates are executed with.
+type NotificationMessage struct {
+	Name      string
+	Username  string
+	Code      string
+	Link      string
+	ExpiresAt time.Time
+	// ExpiresInMinutes is the validity left, rounded up
+	ExpiresInMinutes int
+}
+
+func newNotificationMessage(code string, expiresAt time.Time) *NotificationMessage {
+	minutes := int((time.Until(expiresAt) + time.Minute - 1) / time.Minute)
+	return &NotificationMessage{Code: code, ExpiresAt: expiresAt, ExpiresInMinutes: minutes}
+}
+
+// tokenLink adds the token as the token query parameter of the page, no link is made without a page.
+func tokenLink(page string, token string) (string, error) {
+	if page == "" {
+		return "", nil
+	}
+	link, err := url.Parse(page)
+	if err != nil {
+		return "", err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// MessageTemplates holds the notification templates by name and locale. The OTP templates are named
+// after the OTP purpose. SMS messages use the body only.
+type MessageTemplates struct {
+	templates map[string]*messageTemplate
+}
+
+func NewMessageTemplates() *MessageTemplates {
+	return &MessageTemplates{templates: map[string]*messageTemplate{}}
+}
+
+// DefaultMessageTemplates returns the built in english templates.
+func DefaultMessageTemplates() *MessageTemplates {
+	templates := NewMessageTemplates()
+	codeBody := "Your verification code is {{.Code}}. It expires in {{.ExpiresInMinutes}} minutes."
+	templates.MustRegister(OTPPurposeEmailChange, defaultTemplateLocale, "Confirm your new email address", codeBody)
+	templates.MustRegister(OTPPurposeLogin, defaultTemplateLocale, "Your login code",
+		"Your login code is {{.Code}}. It expires in {{.ExpiresInMinutes}} minutes.")
+	templates.MustRegister(OTPPurposeReset, defaultTemplateLocale, "Your password reset code",
+		"Your password reset code is {{.Code}}. It expires in {{.ExpiresInMinutes}} minutes.")
+	templates.MustRegister(OTPPurposePhoneVerify, defaultTemplateLocale, "Confirm your phone number", codeBody)
+	templates.MustRegister(TemplatePasswordReset, defaultTemplateLocale, "Reset your password",
+		"Hello {{.Name}},\n\nuse this token to reset your password: {{.Code}}\n\nIt expires in {{.ExpiresInMinutes}} minutes. "+
+			"If you did not ask for a password reset you can ignore this message.")
+	templates.MustRegister(TemplateEmailVerify, defaultTemplateLocale, "Verify your email address",
+		"Hello {{.Name}},\n\nconfirm your email address {{if .Link}}by opening {{.Link}}{{else}}with this token: {{.Code}}{{end}}\n\n"+
+			"It expires in {{.ExpiresInMinutes}} minutes.")
+	templates.MustRegister(TemplateMagicLink, defaultTemplateLocale, "Your sign in link",
+		"Hello {{.Name}},\n\nsign in {{if .Link}}by opening {{.Link}}{{else}}with this token: {{.Code}}{{end}}\n\n"+
+			"It expires in {{.ExpiresInMinutes}} minutes and works once. "+
+			"If you did not ask to sign in you can ignore this message.")
+	return templates
+}
+
+// Register parses and adds the template for the name in the locale, replacing an existing one.
+func (m *MessageTemplates) Register(name string, locale string, subject string, body string) error {
+	subjectTemplate, err := template.New(name + ".subject").Parse(subject)
+	if err != nil {
+		return err
+	}
+	bodyTemplate, err := template.New(name + ".body").Parse(body)
+	if err != nil {
+		return err
+	}
+	m.templates[name+"/"+strings.ToLower(locale)] = &messageTemplate{subject: subjectTemplate, body: bodyTemplate}
+	return nil
+}
+
+func (m *MessageTemplates) MustRegister(name string, locale string, subject string, body string) {
+	if err := m.Register(name, locale, subject, body); err != nil {
+		panic(err)
+	}
+}
+
+// Render executes the template for the name in the locale. A locale like fr-CA falls back to fr, then
+// to the default english template.
+func (m *MessageTemplates) Render(name string, locale string, message *NotificationMessage) (subject string, body string, err error) {
+	locale = strings.ToLower(strings.Replace(locale, "_", "-", -1))
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, defaultTemplateLocale)
+	for _, candidate := range candidates {
+		if t, ok := m.templates[name+"/"+candidate]; ok {
+			subjectBuffer, bodyBuffer := &bytes.Buffer{}, &bytes.Buffer{}
+			if err = t.subject.Execute(subjectBuffer, message); err != nil {
+				return "", "", err
+			}
+			if err = t.body.Execute(bodyBuffer, message); err != nil {
+				return "", "", err
+			}
+			return subjectBuffer.String(), bodyBuffer.String(), nil
+		}
+	}
+	return "", "", fmt.Errorf("no message template %s", name)
+}
+
+// FileSender writes the messages to a file or stdout instead of delivering them, for development and
+// tests only: the codes and tokens in the messages end up in plain text wherever the writer goes.
+type FileSender struct {
+	Writer io.Writer
+	mu     sync.Mutex
+}
+
+func NewStdoutSender() *FileSender {
+	return &FileSender{Writer: os.Stdout}
+}
+
+func NewFileSender(path string) (*FileSender, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSender{Writer: file}, nil
+}
+
+func (f *FileSender) SendEmail(_ context.Context, to string, subject string, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := fmt.Fprintf(f.Writer, "To: %s\nSubject: %s\n\n%s\n\n", to, subject, body)
+	return err
+}
+
+func (f *FileSender) SendSMS(_ context.Context, to string, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := fmt.Fprintf(f.Writer, "SMS To: %s\n\n%s\n\n", to, body)
+	return err
+}
+
+// SMTPSender delivers plain text email through an SMTP server. Auth is used when set, the standard
+// library only sends PLAIN credentials over TLS or to localhost.
+type SMTPSender struct {
+	Address string
+	From    string
+	Auth    smtp.Auth
+}
+
+func NewSMTPSender(address string, from string, username string, password string) *SMTPSender {
+	sender := &SMTPSender{Address: address, From: from}
+	if username != "" {
+		host := address
+		if i := strings.LastIndex(address, ":"); i >= 0 {
+			host = address[:i]
+		}
+		sender.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return sender
+}
+
+func (s *SMTPSender) SendEmail(_ context.Context, to string, subject string, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("invalid email header")
+	}
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", s.From)
+	fmt.Fprintf(message, "To: %s\r\n", to)
+	fmt.Fprintf(message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(s.Address, s.Auth, s.From, []string{to}, message.Bytes())
+}
+
+// NotificationServiceImpl renders the message templates in the locale of the user and hands them to
+// the email or SMS sender. Email goes through SMTP when Config.SMTPAddress is set. Both channels write
+// to Config.DevNotificationFile when it is set, email only when SMTP is not configured. A channel
+// without a sender fails to notify with ErrNoNotificationSender, the service can still be built
+// for deployments which never notify.
+type NotificationServiceImpl struct {
+	Config    *Config
+	Email     IEmailSender
+	SMS       ISMSSender
+	Templates *MessageTemplates
+}
+
+func NewNotificationServiceImpl(config *Config) (*NotificationServiceImpl, error) {
+	notifications := &NotificationServiceImpl{
+		Config:    config,
+		Templates: DefaultMessageTemplates(),
+	}
+	if config.DevNotificationFile != "" {
+		fileSender := NewStdoutSender()
+		if config.DevNotificationFile != "-" {
+			var err error
+			if fileSender, err = NewFileSender(config.DevNotificationFile); err != nil {
+				return nil, err
+			}
+		}
+		notifications.Email = fileSender
+		notifications.SMS = fileSender
+	}
+	if config.SMTPAddress != "" {
+		notifications.Email = NewSMTPSender(config.SMTPAddress, config.SMTPFrom, config.SMTPUsername, config.SMTPPassword)
+	}
+	return notifications, nil
+}
+
+// Notify sends the named message to the address over the channel, an email address or a phone number.
+func (n *NotificationServiceImpl) Notify(ctx context.Context, user *models.UserModel, channel string, to string, name string, message *NotificationMessage) error {
+	if to == "" {
+		return fmt.Errorf("no %s address to notify user %d", channel, user.ID)
+	}
+	locale := ""
+	if user.Metadata != nil {
+		locale = user.Metadata.GetLocale()
+		message.Name = user.Metadata.GetName()
+	}
+	message.Username = user.Username
+	if message.Name == "" {
+		message.Name = user.Username
+	}
+	subject, body, err := n.Templates.Render(name, locale, message)
+	if err != nil {
+		return err
+	}
+	switch channel {
+	case NotificationChannelEmail:
+		if n.Email == nil {
+			return ErrNoNotificationSender
+		}
+		return n.Email.SendEmail(ctx, to, subject, body)
+	case NotificationChannelSMS:
+		if n.SMS == nil {
+			return ErrNoNotificationSender
+		}
+		return n.SMS.SendSMS(ctx, to, body)
+	default:
+		return fmt.Errorf("unsupported notification channel %s", channel)
+	}
+}
+
+func (n *NotificationServiceImpl) NotifyOTP(ctx context.Context, user *models.UserModel, channel string, to string, purpose string, code string, expiresAt time.Time) error {
+	return n.Notify(ctx, user, channel, to, purpose, newNotificationMessage(code, expiresAt))
+}
+
+func (n *NotificationServiceImpl) NotifyPasswordReset(ctx context.Context, user *models.UserModel, token string, expiresAt time.Time) error {
+	message := newNotificationMessage(token, expiresAt)
+	return n.Notify(ctx, user, NotificationChannelEmail, user.EmailAddress, TemplatePasswordReset, message)
+}
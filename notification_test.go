@@ -0,0 +1,167 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageTemplates_Render(t *testing.T) {
+	templates := DefaultMessageTemplates()
+	templates.MustRegister(OTPPurposeLogin, "fr", "Votre code de connexion", "Votre code est {{.Code}}.")
+	message := &NotificationMessage{Code: "123456", ExpiresInMinutes: 10}
+	subject, body, err := templates.Render(OTPPurposeLogin, "fr_CA", message)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Votre code de connexion", subject)
+		assert.Equal(t, "Votre code est 123456.", body)
+	}
+	subject, body, err = templates.Render(OTPPurposeLogin, "de", message)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Your login code", subject)
+		assert.Equal(t, "Your login code is 123456. It expires in 10 minutes.", body)
+	}
+	_, _, err = templates.Render("unknown", "en", message)
+	assert.Error(t, err)
+}
+
+// serveSMTP accepts one SMTP session on a local port and sends the message data to the channel.
+func serveSMTP(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		data := &bytes.Buffer{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case command == "DATA":
+				reply("354 end with .")
+				for {
+					line, err = reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPSender_SendEmail(t *testing.T) {
+	address, received := serveSMTP(t)
+	sender := NewSMTPSender(address, "noreply@domain.com", "", "")
+	ctx := context.Background()
+	assert.Error(t, sender.SendEmail(ctx, "user@domain.com\r\nBcc: other@domain.com", "subject", "body"))
+	if !assert.NoError(t, sender.SendEmail(ctx, "user@domain.com", "Your login code", "code 123456")) {
+		return
+	}
+	select {
+	case data := <-received:
+		assert.Contains(t, data, "To: user@domain.com\r\n")
+		assert.Contains(t, data, "Subject: Your login code\r\n")
+		assert.Contains(t, data, "\r\n\r\ncode 123456")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+// newBufferNotifier returns a notifier writing the messages of both channels to the buffer.
+func newBufferNotifier(config *Config) (*NotificationServiceImpl, *bytes.Buffer) {
+	output := &bytes.Buffer{}
+	notifier := &NotificationServiceImpl{
+		Config:    config,
+		Email:     &FileSender{Writer: output},
+		SMS:       &FileSender{Writer: output},
+		Templates: DefaultMessageTemplates(),
+	}
+	return notifier, output
+}
+
+func TestNewNotificationServiceImpl(t *testing.T) {
+	notifier, err := NewNotificationServiceImpl(&Config{})
+	if assert.NoError(t, err) {
+		err = notifier.Notify(context.Background(), TestUser, NotificationChannelEmail, TestUser.EmailAddress, OTPPurposeLogin,
+			&NotificationMessage{Code: "123456"})
+		assert.Equal(t, ErrNoNotificationSender, err)
+	}
+	notifier, err = NewNotificationServiceImpl(&Config{SMTPAddress: "localhost:25"})
+	if assert.NoError(t, err) {
+		assert.IsType(t, &SMTPSender{}, notifier.Email)
+		assert.Nil(t, notifier.SMS)
+		err = notifier.Notify(context.Background(), TestUser, NotificationChannelSMS, "+15550100", OTPPurposeLogin,
+			&NotificationMessage{Code: "123456"})
+		assert.Equal(t, ErrNoNotificationSender, err)
+	}
+	notifier, err = NewNotificationServiceImpl(&Config{DevNotificationFile: "-"})
+	if assert.NoError(t, err) {
+		assert.IsType(t, &FileSender{}, notifier.Email)
+		assert.IsType(t, &FileSender{}, notifier.SMS)
+	}
+}
+
+func TestUserStoreServiceImpl_DeliverUserOTP(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{EncryptionKey: "otp-key"}
+	notifier, output := newBufferNotifier(config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), notifier)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	codePattern := regexp.MustCompile(`code is (\d{6})`)
+	t.Run("email", func(t *testing.T) {
+		output.Reset()
+		if !assert.NoError(t, userStoreService.DeliverUserOTP(ctx, TestUser.ID, OTPPurposeLogin, NotificationChannelEmail)) {
+			return
+		}
+		assert.Contains(t, output.String(), "To: user@domain.com\nSubject: Your login code")
+		match := codePattern.FindStringSubmatch(output.String())
+		if assert.Len(t, match, 2) {
+			assert.NoError(t, userStoreService.ValidateOTP(ctx, TestUser.ID, OTPPurposeLogin, match[1]))
+		}
+	})
+	t.Run("sms", func(t *testing.T) {
+		output.Reset()
+		err := userStoreService.DeliverUserOTP(ctx, TestUser.ID, OTPPurposeLogin, NotificationChannelSMS)
+		assert.EqualError(t, err, "no sms address to notify user 1")
+		metadata := &models.UserMetadata{}
+		metadata.SetPhoneNumber("+15550100")
+		if !assert.NoError(t, userStoreService.PatchUser(ctx, TestUser.ID, metadata)) {
+			return
+		}
+		if assert.NoError(t, userStoreService.DeliverUserOTP(ctx, TestUser.ID, OTPPurposeLogin, NotificationChannelSMS)) {
+			assert.Contains(t, output.String(), "SMS To: +15550100")
+		}
+	})
+	rollbackTransaction(userStoreService.Db)
+}
@@ -0,0 +1,331 @@
+package core
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	HashArgon2id     = "argon2id"
+	HashScrypt       = "scrypt"
+	HashBcrypt       = "bcrypt"
+	HashPBKDF2SHA1   = "pbkdf2-sha1"
+	HashPBKDF2SHA256 = "pbkdf2-sha256"
+	HashPBKDF2SHA512 = "pbkdf2-sha512"
+	HashSHA256Salted = "sha256-salted"
+)
+
+const (
+	defaultArgon2Memory      = 19 * 1024
+	defaultArgon2Iterations  = 2
+	defaultArgon2Parallelism = 1
+	defaultScryptCost        = 15
+	defaultPBKDF2Iterations  = 600000
+	passwordSaltLength       = 16
+	passwordKeyLength        = 32
+)
+
+var b64 = base64.RawStdEncoding
+
+// PasswordHasher hashes with the configured algorithm and verifies any supported encoding. Hashes
+// are encoded in the PHC string format, bcrypt keeps its own modular crypt format, e.g.
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//	$pbkdf2-sha256$i=600000,l=32$<salt>$<hash>
+type PasswordHasher struct {
+	Algorithm         string
+	BcryptCost        int
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+	ScryptCost        uint8
+	PBKDF2Iterations  int
+}
+
+// NewPasswordHasher reads the hashing parameters from the config, unset ones take the recommended
+// defaults.
+func NewPasswordHasher(config *Config) *PasswordHasher {
+	hasher := &PasswordHasher{
+		Algorithm:         config.PasswordHashAlgorithm,
+		BcryptCost:        config.PasswordCost,
+		Argon2Memory:      config.Argon2Memory,
+		Argon2Iterations:  config.Argon2Iterations,
+		Argon2Parallelism: config.Argon2Parallelism,
+		ScryptCost:        config.ScryptCost,
+		PBKDF2Iterations:  config.PBKDF2Iterations,
+	}
+	if hasher.Algorithm == "" {
+		hasher.Algorithm = HashArgon2id
+	}
+	if hasher.BcryptCost < bcrypt.MinCost {
+		hasher.BcryptCost = bcrypt.DefaultCost
+	}
+	if hasher.Argon2Memory == 0 {
+		hasher.Argon2Memory = defaultArgon2Memory
+	}
+	if hasher.Argon2Iterations == 0 {
+		hasher.Argon2Iterations = defaultArgon2Iterations
+	}
+	if hasher.Argon2Parallelism == 0 {
+		hasher.Argon2Parallelism = defaultArgon2Parallelism
+	}
+	if hasher.ScryptCost == 0 {
+		hasher.ScryptCost = defaultScryptCost
+	}
+	if hasher.PBKDF2Iterations == 0 {
+		hasher.PBKDF2Iterations = defaultPBKDF2Iterations
+	}
+	return hasher
+}
+
+func (p *PasswordHasher) Hash(password string) (string, error) {
+	if p.Algorithm == HashBcrypt {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		return string(hashed), err
+	}
+	salt, err := GenerateRandomBytes(passwordSaltLength)
+	if err != nil {
+		return "", err
+	}
+	encoded := &phcString{Algorithm: p.Algorithm, Salt: salt, Params: map[string]int{}}
+	switch p.Algorithm {
+	case HashArgon2id:
+		encoded.Version = argon2.Version
+		encoded.Params["m"] = int(p.Argon2Memory)
+		encoded.Params["t"] = int(p.Argon2Iterations)
+		encoded.Params["p"] = int(p.Argon2Parallelism)
+	case HashScrypt:
+		encoded.Params["ln"] = int(p.ScryptCost)
+		encoded.Params["r"] = 8
+		encoded.Params["p"] = 1
+	case HashPBKDF2SHA1, HashPBKDF2SHA256, HashPBKDF2SHA512:
+		encoded.Params["i"] = p.PBKDF2Iterations
+		encoded.Params["l"] = passwordKeyLength
+	default:
+		return "", fmt.Errorf("password hash algorithm %s is not supported", p.Algorithm)
+	}
+	encoded.Hash, err = encoded.derive(password, passwordKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return encoded.String(), nil
+}
+
+func (p *PasswordHasher) Verify(encoded string, password string) (bool, error) {
+	if isBcryptHash(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	parsed, err := parsePHCString(encoded)
+	if err != nil {
+		return false, err
+	}
+	derived, err := parsed.derive(password, len(parsed.Hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(derived, parsed.Hash) == 1, nil
+}
+
+// NeedsRehash tells whether the hash was made with another algorithm or other parameters than the
+// configured ones.
+func (p *PasswordHasher) NeedsRehash(encoded string) bool {
+	if isBcryptHash(encoded) {
+		if p.Algorithm != HashBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != p.BcryptCost
+	}
+	parsed, err := parsePHCString(encoded)
+	if err != nil || parsed.Algorithm != p.Algorithm {
+		return true
+	}
+	switch p.Algorithm {
+	case HashArgon2id:
+		return parsed.Version != argon2.Version || parsed.Params["m"] != int(p.Argon2Memory) ||
+			parsed.Params["t"] != int(p.Argon2Iterations) || parsed.Params["p"] != int(p.Argon2Parallelism)
+	case HashScrypt:
+		return parsed.Params["ln"] != int(p.ScryptCost)
+	default:
+		return parsed.Params["i"] != p.PBKDF2Iterations
+	}
+}
+
+// passwordHashAlgorithm returns the algorithm a hash is encoded with, or an empty string when the
+// encoding is not recognized.
+func passwordHashAlgorithm(encoded string) string {
+	if isBcryptHash(encoded) {
+		return HashBcrypt
+	}
+	parsed, err := parsePHCString(encoded)
+	if err != nil {
+		return ""
+	}
+	return parsed.Algorithm
+}
+
+// encodeForeignHash brings a hash exported by another identity system to the PHC string format,
+// so it can be verified until the password is rehashed on the next login. The supported formats are
+//
+//	sha256-salted  <salt>$<hex digest>, the digest being SHA-256(salt || password)
+//	pbkdf2-sha1    $pbkdf2-sha1$i=<iterations>,l=<length>$<base64 salt>$<base64 hash>
+func encodeForeignHash(algorithm string, value string) (string, error) {
+	switch algorithm {
+	case HashSHA256Salted:
+		separator := strings.LastIndex(value, "$")
+		if separator < 0 {
+			return "", errors.New("salted sha256 hash must be formatted as salt$digest")
+		}
+		digest, err := hex.DecodeString(value[separator+1:])
+		if err != nil || len(digest) != sha256.Size {
+			return "", errors.New("invalid salted sha256 digest")
+		}
+		encoded := &phcString{Algorithm: HashSHA256Salted, Salt: []byte(value[:separator]), Hash: digest}
+		return encoded.String(), nil
+	case HashPBKDF2SHA1:
+		parsed, err := parsePHCString(value)
+		if err != nil {
+			return "", err
+		}
+		if parsed.Algorithm != HashPBKDF2SHA1 || parsed.Params["i"] <= 0 {
+			return "", errors.New("invalid pbkdf2-sha1 hash")
+		}
+		return parsed.String(), nil
+	default:
+		return "", fmt.Errorf("foreign password hash algorithm %s is not supported", algorithm)
+	}
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+type phcString struct {
+	Algorithm string
+	Version   int
+	Params    map[string]int
+	Salt      []byte
+	Hash      []byte
+}
+
+var phcParamOrder = []string{"m", "t", "ln", "r", "p", "i", "l"}
+
+func (h *phcString) String() string {
+	var builder strings.Builder
+	builder.WriteString("$" + h.Algorithm)
+	if h.Version != 0 {
+		builder.WriteString("$v=" + strconv.Itoa(h.Version))
+	}
+	params := make([]string, 0, len(h.Params))
+	for _, name := range phcParamOrder {
+		if value, ok := h.Params[name]; ok {
+			params = append(params, name+"="+strconv.Itoa(value))
+		}
+	}
+	if len(params) > 0 {
+		builder.WriteString("$" + strings.Join(params, ","))
+	}
+	builder.WriteString("$" + b64.EncodeToString(h.Salt))
+	builder.WriteString("$" + b64.EncodeToString(h.Hash))
+	return builder.String()
+}
+
+func parsePHCString(encoded string) (*phcString, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 4 || parts[0] != "" {
+		return nil, errors.New("invalid password hash encoding")
+	}
+	parsed := &phcString{Algorithm: parts[1], Params: map[string]int{}}
+	parts = parts[2:]
+	if strings.HasPrefix(parts[0], "v=") {
+		version, err := strconv.Atoi(strings.TrimPrefix(parts[0], "v="))
+		if err != nil {
+			return nil, errors.New("invalid password hash version")
+		}
+		parsed.Version = version
+		parts = parts[1:]
+	}
+	if len(parts) == 2 {
+		parts = append([]string{""}, parts...)
+	}
+	if len(parts) != 3 {
+		return nil, errors.New("invalid password hash encoding")
+	}
+	for _, param := range strings.Split(parts[0], ",") {
+		if param == "" {
+			continue
+		}
+		nameValue := strings.SplitN(param, "=", 2)
+		if len(nameValue) != 2 {
+			return nil, errors.New("invalid password hash parameter")
+		}
+		value, err := strconv.Atoi(nameValue[1])
+		if err != nil {
+			return nil, errors.New("invalid password hash parameter")
+		}
+		parsed.Params[nameValue[0]] = value
+	}
+	var err error
+	if parsed.Salt, err = b64.DecodeString(parts[1]); err != nil {
+		return nil, errors.New("invalid password hash salt")
+	}
+	if parsed.Hash, err = b64.DecodeString(parts[2]); err != nil || len(parsed.Hash) == 0 {
+		return nil, errors.New("invalid password hash")
+	}
+	return parsed, nil
+}
+
+func (h *phcString) derive(password string, keyLength int) ([]byte, error) {
+	switch h.Algorithm {
+	case HashArgon2id:
+		if h.Version != argon2.Version || h.Params["m"] <= 0 || h.Params["t"] <= 0 || h.Params["p"] <= 0 || h.Params["p"] > 255 {
+			return nil, errors.New("invalid argon2id parameters")
+		}
+		return argon2.IDKey([]byte(password), h.Salt, uint32(h.Params["t"]), uint32(h.Params["m"]),
+			uint8(h.Params["p"]), uint32(keyLength)), nil
+	case HashScrypt:
+		if h.Params["ln"] <= 0 || h.Params["ln"] > 30 {
+			return nil, errors.New("invalid scrypt parameters")
+		}
+		return scrypt.Key([]byte(password), h.Salt, 1<<uint(h.Params["ln"]), h.Params["r"], h.Params["p"], keyLength)
+	case HashPBKDF2SHA1, HashPBKDF2SHA256, HashPBKDF2SHA512:
+		if h.Params["i"] <= 0 {
+			return nil, errors.New("invalid pbkdf2 parameters")
+		}
+		return pbkdf2.Key([]byte(password), h.Salt, h.Params["i"], keyLength, pbkdf2Hash(h.Algorithm)), nil
+	case HashSHA256Salted:
+		digest := sha256.Sum256(append(append([]byte{}, h.Salt...), password...))
+		return digest[:], nil
+	default:
+		return nil, fmt.Errorf("password hash algorithm %s is not supported", h.Algorithm)
+	}
+}
+
+func pbkdf2Hash(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case HashPBKDF2SHA1:
+		return sha1.New
+	case HashPBKDF2SHA512:
+		return sha512.New
+	default:
+		return sha256.New
+	}
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	algorithms := []string{HashArgon2id, HashScrypt, HashBcrypt, HashPBKDF2SHA1, HashPBKDF2SHA256, HashPBKDF2SHA512}
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			hasher := NewPasswordHasher(&Config{PasswordHashAlgorithm: algorithm, PBKDF2Iterations: 1000})
+			encoded, err := hasher.Hash("password")
+			if !assert.NoError(t, err) {
+				return
+			}
+			if algorithm != HashBcrypt {
+				assert.True(t, strings.HasPrefix(encoded, "$"+algorithm+"$"))
+			}
+			matched, err := hasher.Verify(encoded, "password")
+			if assert.NoError(t, err) {
+				assert.True(t, matched)
+			}
+			matched, err = hasher.Verify(encoded, "password1")
+			if assert.NoError(t, err) {
+				assert.False(t, matched)
+			}
+			assert.False(t, hasher.NeedsRehash(encoded))
+		})
+	}
+	t.Run("needs rehash", func(t *testing.T) {
+		weak := NewPasswordHasher(&Config{Argon2Memory: 1024, Argon2Iterations: 1})
+		encoded, err := weak.Hash("password")
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, NewPasswordHasher(&Config{}).NeedsRehash(encoded))
+		assert.True(t, NewPasswordHasher(&Config{PasswordHashAlgorithm: HashScrypt}).NeedsRehash(encoded))
+		matched, err := NewPasswordHasher(&Config{PasswordHashAlgorithm: HashBcrypt}).Verify(encoded, "password")
+		if assert.NoError(t, err) {
+			assert.True(t, matched, "any supported encoding must verify")
+		}
+	})
+	t.Run("invalid encoding", func(t *testing.T) {
+		_, err := NewPasswordHasher(&Config{}).Verify("$argon2id$v=19$m=x$salt$hash", "password")
+		assert.Error(t, err)
+		_, err = NewPasswordHasher(&Config{}).Verify("plain", "password")
+		assert.Error(t, err)
+	})
+}
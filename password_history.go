@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+)
+
+// passwordReused tells whether the password matches the current one or one of the last
+// Config.PasswordHistorySize passwords of the user. History is disabled when the size is zero.
+func (u *UserStoreServiceImpl) passwordReused(ctx context.Context, id uint, password string) (bool, error) {
+	if u.Config.PasswordHistorySize == 0 {
+		return false, nil
+	}
+	db := u.Db.WithContext(ctx)
+	var hashes []string
+	err := db.Model(&models.UserCredentials{}).Where("user_id = ? and cred_type = ?", id, CredTypePassword).
+		Pluck("value", &hashes).Error
+	if err != nil {
+		return false, err
+	}
+	var history []string
+	err = db.Model(&models.UserPasswordHistory{}).Where("user_id = ?", id).Order("id desc").
+		Limit(int(u.Config.PasswordHistorySize)).Pluck("value", &history).Error
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range append(hashes, history...) {
+		// hashes in an unknown encoding can not be compared, they are not a reason to reject
+		if matched, err := u.Hasher.Verify(hash, password); err == nil && matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// replacePassword stores the new password hash, records it in the history and prunes the entries
+// beyond the history size.
+func (u *UserStoreServiceImpl) replacePassword(ctx context.Context, id uint, hashed string, algorithm string) error {
+	return u.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := updateCredential(tx, id, hashed, CredTypePassword, algorithm)
+		if err != nil || u.Config.PasswordHistorySize == 0 {
+			return err
+		}
+		err = tx.Create(&models.UserPasswordHistory{UserID: id, Value: hashed, Algorithm: algorithm}).Error
+		if err != nil {
+			return err
+		}
+		var entries []uint
+		err = tx.Model(&models.UserPasswordHistory{}).Where("user_id = ?", id).Order("id desc").
+			Pluck("id", &entries).Error
+		if err != nil || uint(len(entries)) <= u.Config.PasswordHistorySize {
+			return err
+		}
+		return tx.Delete(&models.UserPasswordHistory{}, entries[u.Config.PasswordHistorySize:]).Error
+	})
+}
@@ -0,0 +1,234 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultPasswordMinLength = 1
+	defaultPasswordMaxLength = 1024
+	// minUserInfoLength keeps a short username or email local part, like "al", from rejecting
+	// every password that happens to contain it.
+	minUserInfoLength = 4
+)
+
+const (
+	ViolationMinLength        = "min_length"
+	ViolationMaxLength        = "max_length"
+	ViolationLowercase        = "lowercase"
+	ViolationUppercase        = "uppercase"
+	ViolationDigit            = "digit"
+	ViolationSymbol           = "symbol"
+	ViolationCharacterClasses = "character_classes"
+	ViolationUsername         = "contains_username"
+	ViolationEmail            = "contains_email"
+	ViolationBlocklisted      = "blocklisted"
+	ViolationReused           = "reused"
+	ViolationBreached         = "breached"
+)
+
+// PasswordPolicy holds the rules a new password must satisfy. The zero value only rejects empty
+// passwords.
+type PasswordPolicy struct {
+	MinLength           uint
+	MaxLength           uint
+	RequireLowercase    bool
+	RequireUppercase    bool
+	RequireDigit        bool
+	RequireSymbol       bool
+	MinCharacterClasses uint
+	DisallowUserInfo    bool
+	// BlocklistFile lists common passwords, one per line, compared case-insensitively
+	BlocklistFile string
+	// BreachedIndexFile is a breached password index built by BuildBreachedPasswordIndex, passwords
+	// seen in breaches more than BreachedThreshold times are rejected
+	BreachedIndexFile string
+	BreachedThreshold uint
+}
+
+// PasswordViolation is a rule the password failed, Limit is the configured bound for length,
+// character class, reuse and breach rules.
+type PasswordViolation struct {
+	Rule  string `json:"rule"`
+	Limit uint   `json:"limit,omitempty"`
+}
+
+// PasswordPolicyError carries all the violations of a rejected password.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	rules := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		rules[i] = violation.Rule
+	}
+	return fmt.Sprintf("password violates policy: %s", strings.Join(rules, ", "))
+}
+
+const (
+	PasswordChangeExpired   = "expired"
+	PasswordChangeRequested = "requested"
+)
+
+// PasswordChangeRequiredError tells that the password is correct but must be changed, because it
+// expired or because an admin asked for it.
+type PasswordChangeRequiredError struct {
+	Reason string `json:"reason"`
+}
+
+func (e *PasswordChangeRequiredError) Error() string {
+	return fmt.Sprintf("password change required: %s", e.Reason)
+}
+
+// PasswordPolicyEngine validates passwords against a policy. It serves the same policy to every
+// user, a provider resolving the policy by group or tenant can replace it on the user service.
+type PasswordPolicyEngine struct {
+	Policy    PasswordPolicy
+	blocklist map[string]struct{}
+	breached  *BreachedPasswordIndex
+	loadErr   error
+	loadOnce  sync.Once
+}
+
+func NewPasswordPolicyEngine(policy PasswordPolicy) *PasswordPolicyEngine {
+	if policy.MinLength == 0 {
+		policy.MinLength = defaultPasswordMinLength
+	}
+	if policy.MaxLength == 0 {
+		policy.MaxLength = defaultPasswordMaxLength
+	}
+	return &PasswordPolicyEngine{Policy: policy}
+}
+
+func (p *PasswordPolicyEngine) GetPasswordPolicy(_ context.Context, _ *models.UserModel) (IPasswordPolicy, error) {
+	return p, nil
+}
+
+// Validate returns the violations of the password for the user, the blocklist and breached index
+// files are loaded on first use.
+func (p *PasswordPolicyEngine) Validate(user *models.UserModel, password string) ([]PasswordViolation, error) {
+	p.loadOnce.Do(p.load)
+	if p.loadErr != nil {
+		return nil, p.loadErr
+	}
+	policy := p.Policy
+	var violations []PasswordViolation
+	length := uint(utf8.RuneCountInString(password))
+	if length < policy.MinLength {
+		violations = append(violations, PasswordViolation{Rule: ViolationMinLength, Limit: policy.MinLength})
+	}
+	if length > policy.MaxLength {
+		violations = append(violations, PasswordViolation{Rule: ViolationMaxLength, Limit: policy.MaxLength})
+	}
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if policy.RequireLowercase && !lower {
+		violations = append(violations, PasswordViolation{Rule: ViolationLowercase})
+	}
+	if policy.RequireUppercase && !upper {
+		violations = append(violations, PasswordViolation{Rule: ViolationUppercase})
+	}
+	if policy.RequireDigit && !digit {
+		violations = append(violations, PasswordViolation{Rule: ViolationDigit})
+	}
+	if policy.RequireSymbol && !symbol {
+		violations = append(violations, PasswordViolation{Rule: ViolationSymbol})
+	}
+	classes := uint(0)
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	if classes < policy.MinCharacterClasses {
+		violations = append(violations, PasswordViolation{Rule: ViolationCharacterClasses, Limit: policy.MinCharacterClasses})
+	}
+	folded := strings.ToLower(password)
+	if policy.DisallowUserInfo && user != nil {
+		if utf8.RuneCountInString(user.Username) >= minUserInfoLength && strings.Contains(folded, strings.ToLower(user.Username)) {
+			violations = append(violations, PasswordViolation{Rule: ViolationUsername})
+		}
+		for _, email := range []string{user.EmailAddress, user.TempEmailAddress} {
+			if email == "" {
+				continue
+			}
+			localPart := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+			if strings.Contains(folded, strings.ToLower(email)) ||
+				(utf8.RuneCountInString(localPart) >= minUserInfoLength && strings.Contains(folded, localPart)) {
+				violations = append(violations, PasswordViolation{Rule: ViolationEmail})
+				break
+			}
+		}
+	}
+	if _, found := p.blocklist[folded]; found {
+		violations = append(violations, PasswordViolation{Rule: ViolationBlocklisted})
+	}
+	if p.breached != nil {
+		prevalence, err := p.breached.Prevalence(password)
+		if err != nil {
+			return nil, err
+		}
+		if uint(prevalence) > policy.BreachedThreshold {
+			violations = append(violations, PasswordViolation{Rule: ViolationBreached, Limit: policy.BreachedThreshold})
+		}
+	}
+	return violations, nil
+}
+
+// Close releases the breached password index.
+func (p *PasswordPolicyEngine) Close() error {
+	if p.breached != nil {
+		return p.breached.Close()
+	}
+	return nil
+}
+
+func (p *PasswordPolicyEngine) load() {
+	p.blocklist = map[string]struct{}{}
+	if p.Policy.BreachedIndexFile != "" {
+		p.breached, p.loadErr = OpenBreachedPasswordIndex(p.Policy.BreachedIndexFile)
+		if p.loadErr != nil {
+			p.loadErr = fmt.Errorf("failed to load breached password index: %w", p.loadErr)
+			return
+		}
+	}
+	if p.Policy.BlocklistFile == "" {
+		return
+	}
+	file, err := os.Open(p.Policy.BlocklistFile)
+	if err != nil {
+		p.loadErr = fmt.Errorf("failed to load password blocklist: %w", err)
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if entry != "" {
+			p.blocklist[entry] = struct{}{}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		p.loadErr = fmt.Errorf("failed to load password blocklist: %w", err)
+	}
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordPolicyEngine_Validate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	blocklist := filepath.Join(dir, "blocklist.txt")
+	err = ioutil.WriteFile(blocklist, []byte("Password1!\nqwerty\n"), 0600)
+	if !assert.NoError(t, err) {
+		return
+	}
+	engine := NewPasswordPolicyEngine(PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        16,
+		RequireLowercase: true,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowUserInfo: true,
+		BlocklistFile:    blocklist,
+	})
+	user := &models.UserModel{Username: "alice", EmailAddress: "wonder@domain.com"}
+	tests := []struct {
+		password   string
+		violations []string
+	}{
+		{"C0mplex!pass", nil},
+		{"short", []string{ViolationMinLength, ViolationUppercase, ViolationDigit, ViolationSymbol}},
+		{"C0mplex!password-too-long", []string{ViolationMaxLength}},
+		{"C0mplex!Alice", []string{ViolationUsername}},
+		{"C0mplex!wonder", []string{ViolationEmail}},
+		{"password1!", []string{ViolationUppercase, ViolationBlocklisted}},
+	}
+	for _, test := range tests {
+		t.Run(test.password, func(t *testing.T) {
+			violations, err := engine.Validate(user, test.password)
+			if !assert.NoError(t, err) {
+				return
+			}
+			var rules []string
+			for _, violation := range violations {
+				rules = append(rules, violation.Rule)
+			}
+			assert.Equal(t, test.violations, rules)
+		})
+	}
+	t.Run("short user info", func(t *testing.T) {
+		shortUser := &models.UserModel{Username: "al", EmailAddress: "bo@domain.com"}
+		violations, err := engine.Validate(shortUser, "C0mplex!al-bo")
+		if assert.NoError(t, err) {
+			assert.Empty(t, violations)
+		}
+	})
+	t.Run("missing blocklist", func(t *testing.T) {
+		engine := NewPasswordPolicyEngine(PasswordPolicy{BlocklistFile: filepath.Join(dir, "missing.txt")})
+		_, err := engine.Validate(user, "password")
+		assert.Error(t, err)
+	})
+}
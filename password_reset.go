@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPasswordResetTTL = 30 * time.Minute
+	resetTokenLength        = 32
+)
+
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// PasswordResetServiceImpl runs the forgotten password flow. Reset tokens are random, stored hashed,
+// expire after Config.PasswordResetTTL and can be used once. The Notifier delivers them to the user.
+type PasswordResetServiceImpl struct {
+	Db         *gorm.DB
+	Config     *Config
+	UserStore  *UserStoreServiceImpl
+	TokenStore ITokenStoreService
+	Notifier   IPasswordResetNotifier
+	deliveries sync.WaitGroup
+}
+
+func NewPasswordResetServiceImpl(db *gorm.DB, config *Config, userStore *UserStoreServiceImpl, tokenStore ITokenStoreService, notifier IPasswordResetNotifier) *PasswordResetServiceImpl {
+	return &PasswordResetServiceImpl{Db: db, Config: config, UserStore: userStore, TokenStore: tokenStore, Notifier: notifier}
+}
+
+// InitiatePasswordReset issues a reset token to the active user with the username or email and
+// revokes the tokens issued before. It succeeds alike when no such user exists, so the caller can not
+// reveal which accounts exist: the token is delivered in the background, a failed delivery is only
+// logged. An error is returned when the store fails.
+func (p *PasswordResetServiceImpl) InitiatePasswordReset(ctx context.Context, login string) error {
+	if login == "" {
+		return nil
+	}
+	db := p.Db.WithContext(ctx)
+	user := &models.UserModel{}
+	result := db.Where("inactive = ?", false).
+		Where(db.Where("username = ?", login).Or("email_address = ?", login)).Limit(1).Find(user)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil
+	}
+	random, err := GenerateRandomBytes(resetTokenLength)
+	if err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	ttl := p.Config.PasswordResetTTL
+	if ttl <= 0 {
+		ttl = defaultPasswordResetTTL
+	}
+	resetToken := &models.UserResetToken{
+		UserID:    user.ID,
+		TokenHash: hashResetToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&models.UserResetToken{}, "user_id = ?", user.ID).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(resetToken).Error
+	})
+	if err != nil {
+		return err
+	}
+	deliverInBackground(&p.deliveries, "password reset", user.ID, func(ctx context.Context) error {
+		return p.Notifier.NotifyPasswordReset(ctx, user, token, resetToken.ExpiresAt)
+	})
+	return nil
+}
+
+// VerifyPasswordResetToken checks the token without using it, to decide whether to show the form
+// for the new password.
+func (p *PasswordResetServiceImpl) VerifyPasswordResetToken(ctx context.Context, token string) error {
+	_, err := p.findResetToken(ctx, token)
+	return err
+}
+
+// CompletePasswordReset sets the new password of the user the token was issued to. The password goes
+// through the policy checks of SetPassword, a rejected password leaves the token usable for another
+// attempt. Once the password is set, every reset token of the user is revoked, along with the access
+// and refresh tokens issued to the user.
+func (p *PasswordResetServiceImpl) CompletePasswordReset(ctx context.Context, token string, password string) error {
+	resetToken, err := p.findResetToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	db := p.Db.WithContext(ctx)
+	now := time.Now()
+	claim := db.Model(resetToken).Where("used_at is null").Update("used_at", &now)
+	if claim.Error != nil {
+		return claim.Error
+	}
+	if claim.RowsAffected != 1 {
+		return ErrInvalidResetToken
+	}
+	err = p.UserStore.SetPassword(ctx, resetToken.UserID, password)
+	if err != nil {
+		db.Model(resetToken).Update("used_at", nil)
+		return err
+	}
+	err = db.Delete(&models.UserResetToken{}, "user_id = ?", resetToken.UserID).Error
+	if err != nil {
+		return err
+	}
+	user, err := p.UserStore.GetUser(ctx, resetToken.UserID)
+	if err != nil {
+		return err
+	}
+	return p.TokenStore.RevokeUserTokens(ctx, user.Username)
+}
+
+func (p *PasswordResetServiceImpl) findResetToken(ctx context.Context, token string) (*models.UserResetToken, error) {
+	db := p.Db.WithContext(ctx)
+	resetToken := &models.UserResetToken{}
+	result := db.Find(resetToken, "token_hash = ? and used_at is null and expires_at > ?", hashResetToken(token), time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrInvalidResetToken
+	}
+	return resetToken, nil
+}
+
+// hashResetToken hashes a token for storage, a fast hash is enough for 256 bit random tokens.
+func hashResetToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// deliverInBackground runs the delivery off the request path, so that the response time does not
+// tell whether an account exists. The request may be over by then, the delivery gets a context of
+// its own and a failure is logged.
+func deliverInBackground(deliveries *sync.WaitGroup, what string, userId uint, deliver func(ctx context.Context) error) {
+	deliveries.Add(1)
+	go func() {
+		defer deliveries.Done()
+		if err := deliver(context.Background()); err != nil {
+			log.Printf("%s delivery to user %d failed: %v", what, userId, err)
+		}
+	}()
+}
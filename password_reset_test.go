@@ -0,0 +1,89 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/identityOrg/oidcsdk"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type recordingResetNotifier struct {
+	tokens map[uint]string
+	err    error
+}
+
+func (r *recordingResetNotifier) NotifyPasswordReset(_ context.Context, user *models.UserModel, token string, _ time.Time) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.tokens[user.ID] = token
+	return nil
+}
+
+func TestPasswordResetServiceImpl(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		PasswordResetTTL: time.Minute,
+		Argon2Memory:     1024,
+		Argon2Iterations: 1,
+	}
+	userStore := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStore.Db = beginTransaction(ctx, userStore.Db)
+	notifier := &recordingResetNotifier{tokens: map[uint]string{}}
+	tokenStore := NewTokenStoreServiceImpl(userStore.Db)
+	resetService := NewPasswordResetServiceImpl(userStore.Db, config, userStore, tokenStore, notifier)
+	id := TestNoCredUser2.ID
+	t.Run("unknown account", func(t *testing.T) {
+		assert.NoError(t, resetService.InitiatePasswordReset(ctx, "nobody@domain.com"))
+		assert.Empty(t, notifier.tokens)
+	})
+	t.Run("by email", func(t *testing.T) {
+		if !assert.NoError(t, resetService.InitiatePasswordReset(ctx, TestNoCredUser2.EmailAddress)) {
+			return
+		}
+		resetService.deliveries.Wait()
+		first := notifier.tokens[id]
+		assert.NoError(t, resetService.VerifyPasswordResetToken(ctx, first))
+		assert.NoError(t, resetService.InitiatePasswordReset(ctx, TestNoCredUser2.Username))
+		resetService.deliveries.Wait()
+		assert.Equal(t, ErrInvalidResetToken, resetService.VerifyPasswordResetToken(ctx, first), "earlier token revoked")
+	})
+	t.Run("complete", func(t *testing.T) {
+		signatures := NewTokenSignMock(time.Now().Add(time.Hour))
+		profile := oidcsdk.RequestProfile{}
+		profile.SetUsername(TestNoCredUser2.Username)
+		if !assert.NoError(t, tokenStore.StoreTokenProfile(ctx, uuid.New().String(), signatures, profile)) {
+			return
+		}
+		token := notifier.tokens[id]
+		err := resetService.CompletePasswordReset(ctx, token, "")
+		assert.IsType(t, &PasswordPolicyError{}, err)
+		assert.NoError(t, resetService.CompletePasswordReset(ctx, token, "reset password"))
+		assert.NoError(t, userStore.ValidatePassword(ctx, id, "reset password"))
+		assert.Equal(t, ErrInvalidResetToken, resetService.CompletePasswordReset(ctx, token, "other password"), "single use")
+		_, _, err = tokenStore.GetProfileWithAccessTokenSign(ctx, signatures.GetATSignature())
+		assert.Error(t, err, "access token revoked")
+		_, _, err = tokenStore.GetProfileWithRefreshTokenSign(ctx, signatures.GetRTSignature())
+		assert.Error(t, err, "refresh token revoked")
+	})
+	t.Run("expired", func(t *testing.T) {
+		if !assert.NoError(t, resetService.InitiatePasswordReset(ctx, TestNoCredUser2.Username)) {
+			return
+		}
+		resetService.deliveries.Wait()
+		userStore.Db.Model(&models.UserResetToken{}).Where("user_id = ?", id).
+			Update("expires_at", time.Now().Add(-time.Second))
+		assert.Equal(t, ErrInvalidResetToken, resetService.CompletePasswordReset(ctx, notifier.tokens[id], "other password"))
+	})
+	t.Run("failed delivery", func(t *testing.T) {
+		notifier.err = errors.New("smtp unavailable")
+		defer func() { notifier.err = nil }()
+		assert.NoError(t, resetService.InitiatePasswordReset(ctx, TestNoCredUser2.Username))
+		resetService.deliveries.Wait()
+	})
+	rollbackTransaction(userStore.Db)
+}
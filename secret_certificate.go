@@ -0,0 +1,229 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"gopkg.in/square/go-jose.v2"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	CertificateModeNone       = ""
+	CertificateModeSelfSigned = "self-signed"
+	CertificateModeRequest    = "csr"
+)
+
+// ConfigureCertificate sets how the keys of the channel are certified. With self-signed mode every
+// key gets a certificate valid till the key expires, with csr mode a certificate request is stored
+// for the key, to be completed with the certificate issued by a CA. The current key of the channel
+// is certified right away when it has no certificate yet.
+func (s *SecretStoreServiceImpl) ConfigureCertificate(ctx context.Context, channelId uint, mode string, subject string) error {
+	if mode != CertificateModeNone && mode != CertificateModeSelfSigned && mode != CertificateModeRequest {
+		return fmt.Errorf("invalid certificate mode %s", mode)
+	}
+	if mode != CertificateModeNone {
+		if _, err := parseDistinguishedName(subject); err != nil {
+			return err
+		}
+	}
+	channel, err := s.GetChannel(ctx, channelId)
+	if err != nil {
+		return err
+	}
+	if mode != CertificateModeNone && (channel.Use != KeyUseSignature || IsSymmetricAlgorithm(channel.Algorithm)) {
+		return fmt.Errorf("channel %s can not be certified", channel.Name)
+	}
+	channel.CertificateMode = mode
+	channel.CertificateSubject = subject
+	db := s.Db.WithContext(ctx)
+	err = db.Model(channel).Select("certificate_mode", "certificate_subject").Updates(channel).Error
+	if err != nil {
+		return err
+	}
+	currentTime := time.Now()
+	for _, secret := range channel.Secrets {
+		if secret.ExpiresAt.After(currentTime) && len(secret.Certificates) == 0 && len(secret.CertificateRequest) == 0 {
+			err = s.certifySecret(ctx, channel, secret)
+			if err != nil {
+				return err
+			}
+			err = db.Save(secret).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SecretStoreServiceImpl) GetCertificateRequest(ctx context.Context, keyId string) ([]byte, error) {
+	secret, err := s.findSecret(ctx, keyId)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret.CertificateRequest) == 0 {
+		return nil, fmt.Errorf("no certificate request pending for secret %s", keyId)
+	}
+	return secret.CertificateRequest, nil
+}
+
+// CompleteCertificateRequest stores the PEM encoded chain issued for the pending certificate request
+// of the secret. The first certificate must certify the key of the secret.
+func (s *SecretStoreServiceImpl) CompleteCertificateRequest(ctx context.Context, keyId string, chain []byte) error {
+	secret, err := s.findSecret(ctx, keyId)
+	if err != nil {
+		return err
+	}
+	if len(secret.CertificateRequest) == 0 {
+		return fmt.Errorf("no certificate request pending for secret %s", keyId)
+	}
+	issued := &models.SecretModel{Certificates: chain}
+	certificates, err := issued.CertificateChain()
+	if err != nil {
+		return err
+	}
+	if len(certificates) == 0 {
+		return errors.New("no certificate found in chain")
+	}
+	custody, err := s.custodyOf(secret)
+	if err != nil {
+		return err
+	}
+	publicKey, err := custody.PublicKey(ctx, secret)
+	if err != nil {
+		return err
+	}
+	leafKey, ok := certificates[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !leafKey.Equal(publicKey) {
+		return fmt.Errorf("certificate does not certify secret %s", keyId)
+	}
+	secret.SetCertificateChain(certificates)
+	secret.CertificateRequest = nil
+	db := s.Db.WithContext(ctx)
+	return db.Model(secret).Select("certificates", "certificate_request").Updates(secret).Error
+}
+
+func (s *SecretStoreServiceImpl) findSecret(ctx context.Context, keyId string) (*models.SecretModel, error) {
+	db := s.Db.WithContext(ctx)
+	secret := &models.SecretModel{}
+	findResult := db.Find(secret, "key_id = ?", keyId)
+	if findResult.Error != nil {
+		return nil, findResult.Error
+	}
+	if findResult.RowsAffected != 1 {
+		return nil, fmt.Errorf("secret not found with kid %s", keyId)
+	}
+	return secret, nil
+}
+
+// certifySecret creates the certificate or the certificate request of a new key, as configured on
+// the channel. The key is used through its custody, so this works for external keys as well.
+func (s *SecretStoreServiceImpl) certifySecret(ctx context.Context, channel *models.SecretChannelModel, secret *models.SecretModel) error {
+	if channel.CertificateMode == CertificateModeNone {
+		return nil
+	}
+	subject, err := parseDistinguishedName(channel.CertificateSubject)
+	if err != nil {
+		return err
+	}
+	custody, err := s.custodyOf(secret)
+	if err != nil {
+		return err
+	}
+	publicKey, err := custody.PublicKey(ctx, secret)
+	if err != nil {
+		return err
+	}
+	signer := &custodySigner{ctx: ctx, custody: custody, secret: secret, publicKey: publicKey}
+	signatureAlgorithm := certificateSignatureAlgorithm(secret.Algorithm, publicKey)
+	if channel.CertificateMode == CertificateModeRequest {
+		request := &x509.CertificateRequest{Subject: subject, SignatureAlgorithm: signatureAlgorithm}
+		der, err := x509.CreateCertificateRequest(rand.Reader, request, signer)
+		if err != nil {
+			return err
+		}
+		secret.CertificateRequest = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+		return nil
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             secret.IssuedAt,
+		NotAfter:              secret.ExpiresAt,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    signatureAlgorithm,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, signer)
+	if err != nil {
+		return err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	secret.SetCertificateChain([]*x509.Certificate{certificate})
+	return nil
+}
+
+// certificateSignatureAlgorithm signs the certificate of an RSA PSS key with PSS, a key held in an HSM
+// may be limited to the mechanism of its algorithm. Other keys use the default of the x509 package.
+func certificateSignatureAlgorithm(algorithm string, publicKey crypto.PublicKey) x509.SignatureAlgorithm {
+	if _, ok := publicKey.(*rsa.PublicKey); !ok {
+		return x509.UnknownSignatureAlgorithm
+	}
+	switch algorithm {
+	case string(jose.PS256):
+		return x509.SHA256WithRSAPSS
+	case string(jose.PS384):
+		return x509.SHA384WithRSAPSS
+	case string(jose.PS512):
+		return x509.SHA512WithRSAPSS
+	default:
+		return x509.UnknownSignatureAlgorithm
+	}
+}
+
+// parseDistinguishedName reads a subject like "CN=cerberus,O=Identity Org,C=IN". Escaped separators
+// are not supported.
+func parseDistinguishedName(dn string) (pkix.Name, error) {
+	name := pkix.Name{}
+	for _, part := range strings.Split(dn, ",") {
+		attribute := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(attribute) != 2 || attribute[1] == "" {
+			return name, fmt.Errorf("invalid subject %s", dn)
+		}
+		value := strings.TrimSpace(attribute[1])
+		switch strings.ToUpper(strings.TrimSpace(attribute[0])) {
+		case "CN":
+			name.CommonName = value
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "C":
+			name.Country = append(name.Country, value)
+		case "ST":
+			name.Province = append(name.Province, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		default:
+			return name, fmt.Errorf("unsupported subject attribute %s", attribute[0])
+		}
+	}
+	return name, nil
+}
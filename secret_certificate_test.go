@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestSecretStoreServiceImpl_ConfigureCertificate(t *testing.T) {
+	enc := NewNoOpTextEncrypt()
+	secretService := NewSecretStoreServiceImpl(TestDb, enc, enc)
+	ctx := context.Background()
+	secretService.Db = beginTransaction(ctx, secretService.Db)
+	t.Run("invalid subject", func(t *testing.T) {
+		channelId, err := secretService.CreateChannel(ctx, "cert-invalid", "ES384", "sig", 10)
+		if assert.NoError(t, err) {
+			err = secretService.ConfigureCertificate(ctx, channelId, CertificateModeSelfSigned, "cerberus")
+			assert.Error(t, err)
+		}
+	})
+	t.Run("self-signed", func(t *testing.T) {
+		channelId, err := secretService.CreateChannel(ctx, "cert-self", "ES256", "sig", 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = secretService.ConfigureCertificate(ctx, channelId, CertificateModeSelfSigned, "CN=cerberus,O=Identity Org")
+		if !assert.NoError(t, err) {
+			return
+		}
+		channel, err := secretService.GetChannel(ctx, channelId)
+		if !assert.NoError(t, err) {
+			return
+		}
+		secret := channel.Secrets[0]
+		secrets, err := secretService.GetAllSecrets(ctx)
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(secrets.Key(secret.KeyId))) {
+			certificates := secrets.Key(secret.KeyId)[0].Certificates
+			if assert.Equal(t, 1, len(certificates)) {
+				assert.Equal(t, "cerberus", certificates[0].Subject.CommonName)
+				assert.Equal(t, secret.ExpiresAt.Unix(), certificates[0].NotAfter.Unix())
+			}
+		}
+	})
+	t.Run("certificate request", func(t *testing.T) {
+		channelId, err := secretService.CreateChannel(ctx, "cert-csr", "RS256", "sig", 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = secretService.ConfigureCertificate(ctx, channelId, CertificateModeRequest, "CN=cerberus")
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = secretService.RenewSecret(ctx, channelId)
+		if !assert.NoError(t, err) {
+			return
+		}
+		channel, err := secretService.GetChannel(ctx, channelId)
+		if !assert.NoError(t, err) || !assert.Equal(t, 2, len(channel.Secrets)) {
+			return
+		}
+		keyId := channel.Secrets[1].KeyId
+		csrPem, err := secretService.GetCertificateRequest(ctx, keyId)
+		if !assert.NoError(t, err) {
+			return
+		}
+		block, _ := pem.Decode(csrPem)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if !assert.NoError(t, err) || !assert.NoError(t, csr.CheckSignature()) {
+			return
+		}
+		caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		caTemplate := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "test ca"},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		caDer, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+		caCertificate, _ := x509.ParseCertificate(caDer)
+		leafTemplate := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		leafDer, _ := x509.CreateCertificate(rand.Reader, leafTemplate, caCertificate, csr.PublicKey, caKey)
+		chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDer})
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})...)
+
+		err = secretService.CompleteCertificateRequest(ctx, channel.Secrets[0].KeyId, chain)
+		assert.Error(t, err, "certificate of another key")
+		err = secretService.CompleteCertificateRequest(ctx, keyId, chain)
+		if assert.NoError(t, err) {
+			_, err = secretService.GetCertificateRequest(ctx, keyId)
+			assert.Error(t, err)
+			secrets, err := secretService.GetAllSecrets(ctx)
+			if assert.NoError(t, err) && assert.Equal(t, 1, len(secrets.Key(keyId))) {
+				assert.Equal(t, 2, len(secrets.Key(keyId)[0].Certificates))
+			}
+		}
+	})
+	t.Run("new channel and import", func(t *testing.T) {
+		secretService.CertificateMode = CertificateModeSelfSigned
+		secretService.CertificateSubject = "CN=cerberus"
+		channelId, err := secretService.CreateChannel(ctx, "cert-default", "PS256", "sig", 10)
+		secretService.CertificateMode = CertificateModeNone
+		if !assert.NoError(t, err) {
+			return
+		}
+		channel, err := secretService.GetChannel(ctx, channelId)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, CertificateModeSelfSigned, channel.CertificateMode)
+		certificates, err := channel.Secrets[0].CertificateChain()
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(certificates)) {
+			assert.Equal(t, x509.SHA256WithRSAPSS, certificates[0].SignatureAlgorithm)
+			certificate := certificates[0]
+			assert.NoError(t, certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature))
+		}
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+		keyId, err := secretService.ImportSecret(ctx, channelId, "", KeyFormatPEM, pemData, "", KeyStateActive)
+		if assert.NoError(t, err) {
+			secrets, err := secretService.GetAllSecrets(ctx)
+			if assert.NoError(t, err) && assert.Equal(t, 1, len(secrets.Key(keyId))) {
+				assert.Equal(t, 1, len(secrets.Key(keyId)[0].Certificates))
+			}
+		}
+	})
+	rollbackTransaction(secretService.Db)
+}
@@ -0,0 +1,429 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/identityOrg/cerberus-core/models"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/pkcs12"
+	"gopkg.in/square/go-jose.v2"
+	"hash"
+	"strings"
+	"time"
+)
+
+const (
+	KeyFormatPEM    = "pem"
+	KeyFormatPKCS12 = "pkcs12"
+	KeyFormatJWK    = "jwk"
+	// KeyFormatJWE is the passphrase encrypted JWK produced by ExportSecret.
+	KeyFormatJWE = "jwe"
+)
+
+const (
+	KeyStateActive  = "active"
+	KeyStateRetired = "retired"
+)
+
+const (
+	minExportPassphraseLength = 12
+	minImportRSABits          = 2048
+)
+
+// ImportSecret adds an externally generated key to the channel. An active key replaces the current
+// key of the channel, a retired key is only published for verifying the tokens it has signed, and is
+// retained for the validity days of the channel before the retention of the channel applies. The
+// key id defaults to the kid of a JWK, or a new one for the other formats. Imported keys are always
+// held in the database. An active key imported without a certificate is certified like a new key of
+// the channel.
+func (s *SecretStoreServiceImpl) ImportSecret(ctx context.Context, channelId uint, keyId string, format string, data []byte, password string, state string) (string, error) {
+	if state != KeyStateActive && state != KeyStateRetired {
+		return "", fmt.Errorf("invalid key state %s", state)
+	}
+	key, certificates, jwkKeyId, err := parseImportedKey(format, data, password)
+	if err != nil {
+		return "", err
+	}
+	channel, err := s.GetChannel(ctx, channelId)
+	if err != nil {
+		return "", err
+	}
+	if !keyMatchesAlgorithm(key, channel.Algorithm) {
+		return "", fmt.Errorf("key can not be used for algorithm %s", channel.Algorithm)
+	}
+	certificates, err = orderCertificateChain(key, certificates)
+	if err != nil {
+		return "", err
+	}
+	if keyId == "" {
+		keyId = jwkKeyId
+	}
+	if keyId == "" {
+		keyId = uuid.New().String()
+	}
+	db := s.Db.WithContext(ctx)
+	var count int64
+	err = db.Model(&models.SecretModel{}).Where("key_id = ?", keyId).Count(&count).Error
+	if err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", fmt.Errorf("secret already exists with kid %s", keyId)
+	}
+	var material []byte
+	if symmetricKey, ok := key.([]byte); ok {
+		material = symmetricKey
+	} else {
+		material, err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", err
+		}
+	}
+	currentTime := time.Now()
+	secret := &models.SecretModel{
+		KeyId:     keyId,
+		IssuedAt:  currentTime,
+		ExpiresAt: currentTime,
+		ChannelId: channelId,
+		Algorithm: channel.Algorithm,
+		Use:       channel.Use,
+		Custody:   CustodyDatabase,
+	}
+	secret.SetCertificateChain(certificates)
+	err = s.databaseCustody().Seal(ctx, secret, material)
+	if err != nil {
+		return "", err
+	}
+	validity := time.Duration(channel.ValidityDay) * 24 * time.Hour
+	if state == KeyStateRetired {
+		retainUntil := currentTime.Add(validity)
+		secret.RetainUntil = &retainUntil
+	}
+	if state == KeyStateActive {
+		err = s.retireSecrets(ctx, channel.Secrets, currentTime)
+		if err != nil {
+			return "", err
+		}
+		secret.ExpiresAt = currentTime.Add(validity)
+		if len(certificates) == 0 {
+			err = s.certifySecret(ctx, channel, secret)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return keyId, db.Save(secret).Error
+}
+
+// ExportSecret returns the key as a JWK, including its certificate chain, encrypted to the
+// passphrase with PBES2. The result can be imported again with the jwe format.
+func (s *SecretStoreServiceImpl) ExportSecret(ctx context.Context, keyId string, passphrase string) ([]byte, error) {
+	if len(passphrase) < minExportPassphraseLength {
+		return nil, fmt.Errorf("export passphrase must have at least %d characters", minExportPassphraseLength)
+	}
+	db := s.Db.WithContext(ctx)
+	secret := &models.SecretModel{}
+	findResult := db.Find(secret, "key_id = ?", keyId)
+	if findResult.Error != nil {
+		return nil, findResult.Error
+	}
+	if findResult.RowsAffected != 1 {
+		return nil, fmt.Errorf("secret not found with kid %s", keyId)
+	}
+	if secret.Custody != "" && secret.Custody != CustodyDatabase {
+		return nil, fmt.Errorf("secret %s is held by %s custody and can not be exported", keyId, secret.Custody)
+	}
+	key, err := s.databaseCustody().PrivateKey(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := secret.CertificateChain()
+	if err != nil {
+		return nil, err
+	}
+	jwk := jose.JSONWebKey{
+		Key:          key,
+		KeyID:        secret.KeyId,
+		Algorithm:    secret.Algorithm,
+		Use:          secret.Use,
+		Certificates: certificates,
+	}
+	jwkJson, err := json.Marshal(jwk)
+	if err != nil {
+		return nil, err
+	}
+	recipient := jose.Recipient{Algorithm: jose.PBES2_HS512_A256KW, Key: passphrase}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, recipient, (&jose.EncrypterOptions{}).WithContentType("jwk+json"))
+	if err != nil {
+		return nil, err
+	}
+	jwe, err := encrypter.Encrypt(jwkJson)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := jwe.CompactSerialize()
+	return []byte(serialized), err
+}
+
+func parseImportedKey(format string, data []byte, password string) (key interface{}, certificates []*x509.Certificate, keyId string, err error) {
+	switch format {
+	case KeyFormatPEM:
+		key, certificates, err = parsePEMKey(data, password)
+		return
+	case KeyFormatPKCS12:
+		var blocks []*pem.Block
+		blocks, err = pkcs12.ToPEM(data, password)
+		if err != nil {
+			return
+		}
+		var pemData []byte
+		for _, block := range blocks {
+			pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes})...)
+		}
+		key, certificates, err = parsePEMKey(pemData, "")
+		return
+	case KeyFormatJWK:
+		return parseJWK(data)
+	case KeyFormatJWE:
+		var jwe *jose.JSONWebEncryption
+		jwe, err = jose.ParseEncrypted(string(data))
+		if err != nil {
+			return
+		}
+		var jwkJson []byte
+		jwkJson, err = jwe.Decrypt(password)
+		if err != nil {
+			return
+		}
+		return parseJWK(jwkJson)
+	default:
+		err = fmt.Errorf("key format %s is not supported", format)
+		return
+	}
+}
+
+func parseJWK(data []byte) (interface{}, []*x509.Certificate, string, error) {
+	jwk := &jose.JSONWebKey{}
+	err := jwk.UnmarshalJSON(data)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if jwk.IsPublic() {
+		return nil, nil, "", errors.New("jwk does not contain a private key")
+	}
+	return jwk.Key, jwk.Certificates, jwk.KeyID, nil
+}
+
+// parsePEMKey reads the first private key of the PEM data, in PKCS1, PKCS8 or SEC1 encoding, and all
+// certificates along with it. An encrypted key has to be encrypted PKCS8, the legacy DEK-Info
+// encryption of PKCS1 and SEC1 keys is rejected.
+func parsePEMKey(data []byte, password string) (key interface{}, certificates []*x509.Certificate, err error) {
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certificates = append(certificates, certificate)
+			continue
+		}
+		if key != nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+		der := block.Bytes
+		if _, legacy := block.Headers["DEK-Info"]; legacy {
+			return nil, nil, errors.New("legacy encrypted pem keys are not supported, " +
+				"convert the key to encrypted pkcs8 with openssl pkcs8 -topk8 -v2 aes-256-cbc")
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			der, err = decryptPKCS8(block.Bytes, password)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		key, err = parsePrivateKey(der)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if key == nil {
+		return nil, nil, errors.New("no private key found in pem data")
+	}
+	return key, certificates, nil
+}
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Parameters struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Parameters struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an ENCRYPTED PRIVATE KEY, as written by openssl pkcs8 -topk8. Only PBES2 with
+// PBKDF2 and AES-CBC is supported, the older PBES1 schemes use broken ciphers.
+func decryptPKCS8(der []byte, password string) ([]byte, error) {
+	info := &encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(der, info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported pkcs8 encryption %s, use pbes2", info.Algorithm.Algorithm)
+	}
+	params := &pbes2Parameters{}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported pkcs8 key derivation %s", params.KeyDerivationFunc.Algorithm)
+	}
+	kdf := &pbkdf2Parameters{}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, kdf); err != nil {
+		return nil, err
+	}
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported pbkdf2 prf %s", kdf.PRF.Algorithm)
+	}
+	var keyLength int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("unsupported pkcs8 cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid pkcs8 encrypted data")
+	}
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(password), kdf.Salt, kdf.IterationCount, keyLength, prf))
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("pkcs8 decryption failed, wrong password")
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("pkcs8 decryption failed, wrong password")
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key encoding")
+}
+
+// keyMatchesAlgorithm tells whether the key can be used for the algorithm. RSA keys need at least
+// minImportRSABits, an ES key has to be on the curve of its algorithm.
+func keyMatchesAlgorithm(key interface{}, algorithm string) bool {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < minImportRSABits {
+			return false
+		}
+		return strings.HasPrefix(algorithm, "RS") || strings.HasPrefix(algorithm, "PS") || strings.HasPrefix(algorithm, "RSA")
+	case *ecdsa.PrivateKey:
+		switch algorithm {
+		case string(jose.ES256):
+			return key.Curve == elliptic.P256()
+		case string(jose.ES384):
+			return key.Curve == elliptic.P384()
+		case string(jose.ES512):
+			return key.Curve == elliptic.P521()
+		}
+		if strings.HasPrefix(algorithm, "ECDH") {
+			return key.Curve == elliptic.P256() || key.Curve == elliptic.P384() || key.Curve == elliptic.P521()
+		}
+		return false
+	case []byte:
+		return IsSymmetricAlgorithm(algorithm)
+	default:
+		return false
+	}
+}
+
+// orderCertificateChain moves the certificate of the key to the front, as required for x5c.
+func orderCertificateChain(key interface{}, certificates []*x509.Certificate) ([]*x509.Certificate, error) {
+	if len(certificates) == 0 {
+		return certificates, nil
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("certificates can only be imported with an asymmetric key")
+	}
+	for i, certificate := range certificates {
+		publicKey, ok := certificate.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if ok && publicKey.Equal(signer.Public()) {
+			ordered := append([]*x509.Certificate{certificate}, certificates[:i]...)
+			return append(ordered, certificates[i+1:]...), nil
+		}
+	}
+	return nil, errors.New("no certificate found for the private key")
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+var errCustodyCanNotDestroy = errors.New("custody can not destroy keys")
+
+// SetChannelRetention sets how many days the retired keys of the channel are kept after they expire,
+// so that the tokens they have signed can still be verified. Zero purges them as soon as they expire.
+func (s *SecretStoreServiceImpl) SetChannelRetention(ctx context.Context, channelId uint, retentionDay uint) error {
+	db := s.Db.WithContext(ctx)
+	channel := &models.SecretChannelModel{}
+	channel.ID = channelId
+	updateResult := db.Model(channel).Update("retention_day", retentionDay)
+	if updateResult.Error != nil {
+		return updateResult.Error
+	}
+	if updateResult.RowsAffected != 1 {
+		return fmt.Errorf("channel not found with id %d", channelId)
+	}
+	return nil
+}
+
+// PurgeExpiredSecrets hard deletes the keys past the retention of their channel, and past the time
+// a retired import is retained until, leaving a tombstone for each. Keys of channels which no longer exist are purged right away. It returns the number of
+// keys purged. The external keys a previous purge failed to destroy are destroyed again.
+func (s *SecretStoreServiceImpl) PurgeExpiredSecrets(ctx context.Context) (int, error) {
+	db := s.Db.WithContext(ctx)
+	channels := make([]*models.SecretChannelModel, 0)
+	err := db.Find(&channels).Error
+	if err != nil {
+		return 0, err
+	}
+	currentTime := time.Now()
+	count := 0
+	channelIds := make([]uint, 0, len(channels))
+	for _, channel := range channels {
+		channelIds = append(channelIds, channel.ID)
+		retention := time.Duration(channel.EffectiveRetentionDay()) * 24 * time.Hour
+		secrets := make([]*models.SecretModel, 0)
+		err = db.Find(&secrets, "channel_id = ? and expires_at < ? and (retain_until is null or retain_until < ?)",
+			channel.ID, currentTime.Add(-retention), currentTime).Error
+		if err != nil {
+			return count, err
+		}
+		err = s.purgeSecrets(ctx, channel.Name, secrets)
+		if err != nil {
+			return count, err
+		}
+		count += len(secrets)
+	}
+	orphans := make([]*models.SecretModel, 0)
+	query := db
+	if len(channelIds) > 0 {
+		query = query.Where("channel_id not in ?", channelIds)
+	}
+	err = query.Find(&orphans).Error
+	if err != nil {
+		return count, err
+	}
+	err = s.purgeSecrets(ctx, "", orphans)
+	if err != nil {
+		return count, err
+	}
+	count += len(orphans)
+	return count, s.destroyPendingKeys(ctx)
+}
+
+func (s *SecretStoreServiceImpl) GetSecretTombstones(ctx context.Context) ([]*models.SecretTombstoneModel, error) {
+	db := s.Db.WithContext(ctx)
+	tombstones := make([]*models.SecretTombstoneModel, 0)
+	findResult := db.Order("id").Find(&tombstones)
+	return tombstones, findResult.Error
+}
+
+// purgeSecrets replaces the secrets by their tombstones. The tombstone of a key held by an external
+// custody keeps the key handle, for destroyPendingKeys to destroy the key once the tombstones are
+// committed, or later when the custody is not available now.
+func (s *SecretStoreServiceImpl) purgeSecrets(ctx context.Context, channelName string, secrets []*models.SecretModel) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	return s.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, secret := range secrets {
+			tombstone := &models.SecretTombstoneModel{
+				KeyId:       secret.KeyId,
+				Algorithm:   secret.Algorithm,
+				Use:         secret.Use,
+				ChannelId:   secret.ChannelId,
+				ChannelName: channelName,
+				IssuedAt:    secret.IssuedAt,
+				ExpiresAt:   secret.ExpiresAt,
+				Custody:     secret.Custody,
+			}
+			if !isDatabaseCustody(secret) {
+				tombstone.KeyHandle = secret.Value
+			}
+			err := tx.Create(tombstone).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Delete(secret).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// destroyPendingKeys destroys the keys of the tombstones still holding a key handle in their custody,
+// and clears the handle of each key destroyed. A key that fails to be destroyed, or whose custody is
+// not available, stays pending to be tried again the next time. A custody that can not destroy keys
+// leaves them pending without an error. It goes through all of them and returns the first error.
+func (s *SecretStoreServiceImpl) destroyPendingKeys(ctx context.Context) error {
+	db := s.Db.WithContext(ctx)
+	tombstones := make([]*models.SecretTombstoneModel, 0)
+	err := db.Find(&tombstones, "key_handle is not null").Error
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, tombstone := range tombstones {
+		secret := &models.SecretModel{
+			KeyId:     tombstone.KeyId,
+			Algorithm: tombstone.Algorithm,
+			Use:       tombstone.Use,
+			Custody:   tombstone.Custody,
+			Value:     tombstone.KeyHandle,
+		}
+		err := s.destroyKey(ctx, secret)
+		if errors.Is(err, errCustodyCanNotDestroy) {
+			continue
+		}
+		if err == nil {
+			err = db.Model(tombstone).Update("key_handle", nil).Error
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("destroying key %s: %w", tombstone.KeyId, err)
+		}
+	}
+	return firstErr
+}
+
+func (s *SecretStoreServiceImpl) destroyKey(ctx context.Context, secret *models.SecretModel) error {
+	custody, err := s.custodyOf(secret)
+	if err != nil {
+		return err
+	}
+	destroyer, ok := custody.(IKeyDestroyer)
+	if !ok {
+		return fmt.Errorf("custody %s: %w", secret.Custody, errCustodyCanNotDestroy)
+	}
+	return destroyer.DestroyKey(ctx, secret)
+}
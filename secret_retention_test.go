@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSecretStoreServiceImpl_PurgeExpiredSecrets(t *testing.T) {
+	enc := NewNoOpTextEncrypt()
+	secretService := NewSecretStoreServiceImpl(TestDb, enc, enc)
+	ctx := context.Background()
+	secretService.Db = beginTransaction(ctx, secretService.Db)
+	channelId, err := secretService.CreateChannel(ctx, "retention", "ES256", "sig", 10)
+	if !assert.NoError(t, err) || !assert.NoError(t, secretService.RenewSecret(ctx, channelId)) {
+		return
+	}
+	channel, err := secretService.GetChannel(ctx, channelId)
+	if !assert.NoError(t, err) {
+		return
+	}
+	retired := channel.Secrets[0]
+	err = secretService.Db.Model(retired).Update("expires_at", time.Now().Add(-7*24*time.Hour)).Error
+	if !assert.NoError(t, err) {
+		return
+	}
+	t.Run("within retention", func(t *testing.T) {
+		count, err := secretService.PurgeExpiredSecrets(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 0, count)
+		}
+	})
+	t.Run("past retention", func(t *testing.T) {
+		err := secretService.SetChannelRetention(ctx, channelId, 5)
+		if !assert.NoError(t, err) {
+			return
+		}
+		count, err := secretService.PurgeExpiredSecrets(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1, count)
+		}
+		secrets, err := secretService.GetAllSecrets(ctx)
+		if assert.NoError(t, err) {
+			assert.Empty(t, secrets.Key(retired.KeyId))
+			assert.NotEmpty(t, secrets.Key(channel.Secrets[1].KeyId))
+		}
+		tombstones, err := secretService.GetSecretTombstones(ctx)
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(tombstones)) {
+			assert.Equal(t, retired.KeyId, tombstones[0].KeyId)
+			assert.Equal(t, "retention", tombstones[0].ChannelName)
+		}
+	})
+	t.Run("zero retention", func(t *testing.T) {
+		err := secretService.RenewSecret(ctx, channelId)
+		if !assert.NoError(t, err) || !assert.NoError(t, secretService.SetChannelRetention(ctx, channelId, 0)) {
+			return
+		}
+		count, err := secretService.PurgeExpiredSecrets(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1, count)
+		}
+	})
+	t.Run("delete channel", func(t *testing.T) {
+		err := secretService.DeleteChannel(ctx, channelId)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var count int64
+		secretService.Db.Model(&models.SecretModel{}).Where("channel_id = ?", channelId).Count(&count)
+		assert.Equal(t, int64(0), count)
+		tombstones, err := secretService.GetSecretTombstones(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 3, len(tombstones))
+		}
+	})
+	t.Run("external custody", func(t *testing.T) {
+		custody := &memoryKeyCustody{keys: map[string]*ecdsa.PrivateKey{}, destroyFailures: 1}
+		secretService.Custody = custody
+		defer func() { secretService.Custody = NewDatabaseKeyCustody(enc, enc) }()
+		channelId, err := secretService.CreateChannel(ctx, "retention-external", "ES256", "sig", 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = secretService.DeleteChannel(ctx, channelId)
+		assert.Error(t, err, "custody unavailable")
+		assert.Equal(t, 1, len(custody.keys))
+		var count int64
+		secretService.Db.Model(&models.SecretModel{}).Where("channel_id = ?", channelId).Count(&count)
+		assert.Equal(t, int64(0), count, "tombstones are committed before the key is destroyed")
+		_, err = secretService.PurgeExpiredSecrets(ctx)
+		if assert.NoError(t, err) {
+			assert.Empty(t, custody.keys)
+			secretService.Db.Model(&models.SecretTombstoneModel{}).Where("key_handle is not null").Count(&count)
+			assert.Equal(t, int64(0), count)
+		}
+	})
+	t.Run("custody unavailable at purge", func(t *testing.T) {
+		custody := &memoryKeyCustody{keys: map[string]*ecdsa.PrivateKey{}}
+		secretService.Custody = custody
+		defer func() { secretService.Custody = NewDatabaseKeyCustody(enc, enc) }()
+		channelId, err := secretService.CreateChannel(ctx, "retention-unavailable", "ES256", "sig", 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+		secretService.Custody = NewDatabaseKeyCustody(enc, enc)
+		assert.Error(t, secretService.DeleteChannel(ctx, channelId))
+		var count int64
+		secretService.Db.Model(&models.SecretTombstoneModel{}).Where("key_handle is not null").Count(&count)
+		assert.Equal(t, int64(1), count, "handle kept for a later purge")
+		secretService.Custody = custody
+		_, err = secretService.PurgeExpiredSecrets(ctx)
+		if assert.NoError(t, err) {
+			assert.Empty(t, custody.keys)
+			secretService.Db.Model(&models.SecretTombstoneModel{}).Where("key_handle is not null").Count(&count)
+			assert.Equal(t, int64(0), count)
+		}
+	})
+	rollbackTransaction(secretService.Db)
+}
@@ -11,42 +11,103 @@ import (
 	"github.com/google/uuid"
 	"github.com/identityOrg/cerberus-core/models"
 	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/cryptosigner"
 	"gorm.io/gorm"
 	"time"
 )
 
 type SecretStoreServiceImpl struct {
-	Db *gorm.DB
+	Db      *gorm.DB
+	TextEnc ITextEncrypts
+	TextDec ITextDecrypts
+	Custody IKeyCustody
+	// CertificateMode and CertificateSubject are given to new asymmetric signature channels, so that
+	// their first key is certified as well. ConfigureCertificate changes them per channel.
+	CertificateMode    string
+	CertificateSubject string
 }
 
-func NewSecretStoreServiceImpl(db *gorm.DB) *SecretStoreServiceImpl {
-	return &SecretStoreServiceImpl{Db: db}
+func NewSecretStoreServiceImpl(db *gorm.DB, dec ITextDecrypts, enc ITextEncrypts) *SecretStoreServiceImpl {
+	return &SecretStoreServiceImpl{Db: db, TextEnc: enc, TextDec: dec, Custody: NewDatabaseKeyCustody(dec, enc)}
 }
 
+// GetAllSecrets returns the asymmetric keys of all channels. Symmetric keys are left out, as the
+// key set is also published as the JWKS of the provider, use GetSymmetricSecrets for them. Keys
+// held by an external custody are returned with their public key only, use GetSigningSecrets to
+// sign with them.
 func (s *SecretStoreServiceImpl) GetAllSecrets(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	return s.getSecrets(ctx, false, false)
+}
+
+func (s *SecretStoreServiceImpl) GetSymmetricSecrets(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	return s.getSecrets(ctx, true, false)
+}
+
+// GetSigningSecrets returns the asymmetric keys like GetAllSecrets, except that the signature keys
+// held by an external custody are a jose.OpaqueSigner signing through the custody. The key set can
+// sign, it can not be published.
+func (s *SecretStoreServiceImpl) GetSigningSecrets(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	return s.getSecrets(ctx, false, true)
+}
+
+func (s *SecretStoreServiceImpl) getSecrets(ctx context.Context, symmetric bool, signing bool) (*jose.JSONWebKeySet, error) {
 	db := s.Db.WithContext(ctx)
 	secrets := make([]models.SecretModel, 0)
-	db.Find(&secrets)
+	// the active key of a channel comes last, as the last key of an algorithm is used for signing
+	db.Order("expires_at").Find(&secrets)
 	keySet := &jose.JSONWebKeySet{
 		Keys: make([]jose.JSONWebKey, 0),
 	}
 	for _, secret := range secrets {
-		key, err := x509.ParsePKCS8PrivateKey(secret.Value)
+		if IsSymmetricAlgorithm(secret.Algorithm) != symmetric {
+			continue
+		}
+		var key interface{}
+		var err error
+		if signing && secret.Use == KeyUseSignature && !isDatabaseCustody(&secret) {
+			key, err = s.opaqueSigner(ctx, &secret)
+		} else {
+			key, err = s.parseSecret(ctx, &secret)
+		}
+		if err != nil {
+			continue
+		}
+		certificates, err := secret.CertificateChain()
 		if err != nil {
 			continue
 		}
 		jwk := jose.JSONWebKey{
-			Key:       key,
-			KeyID:     secret.KeyId,
-			Algorithm: secret.Algorithm,
-			Use:       secret.Use,
+			Key:          key,
+			KeyID:        secret.KeyId,
+			Algorithm:    secret.Algorithm,
+			Use:          secret.Use,
+			Certificates: certificates,
 		}
 		keySet.Keys = append(keySet.Keys, jwk)
 	}
 	return keySet, nil
 }
 
+// SigningSecretStore is the oidcsdk.ISecretStore bound for the token strategy to sign tokens with.
+// It hands out GetSigningSecrets, so tokens are signed with keys held by an external custody as well.
+// Its keys can not be published, the JWKS endpoint of the provider is to be given the
+// ISecretStoreService instead.
+type SigningSecretStore struct {
+	SecretStore *SecretStoreServiceImpl
+}
+
+func NewSigningSecretStore(secretStore *SecretStoreServiceImpl) *SigningSecretStore {
+	return &SigningSecretStore{SecretStore: secretStore}
+}
+
+func (s *SigningSecretStore) GetAllSecrets(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	return s.SecretStore.GetSigningSecrets(ctx)
+}
+
 func (s *SecretStoreServiceImpl) CreateChannel(ctx context.Context, name string, algorithm string, use string, validityDay uint) (uint, error) {
+	if IsEncryptionAlgorithm(algorithm) != (use == KeyUseEncryption) {
+		return 0, fmt.Errorf("algorithm %s can not be used for %s", algorithm, use)
+	}
 	channel := &models.SecretChannelModel{
 		Name:        name,
 		Algorithm:   algorithm,
@@ -59,13 +120,20 @@ func (s *SecretStoreServiceImpl) CreateChannel(ctx context.Context, name string,
 		Algorithm: algorithm,
 		Use:       use,
 	}
-	var err error
-	secret.Value, err = s.createSecret(algorithm)
+	if use == KeyUseSignature && !IsSymmetricAlgorithm(algorithm) {
+		channel.CertificateMode = s.CertificateMode
+		channel.CertificateSubject = s.CertificateSubject
+	}
+	err := s.createSecret(ctx, secret)
 	if err != nil {
 		return 0, err
 	}
 	validityHour := time.Duration(validityDay) * time.Duration(24)
 	secret.ExpiresAt = time.Now().Add(validityHour * time.Hour)
+	err = s.certifySecret(ctx, channel, secret)
+	if err != nil {
+		return 0, err
+	}
 	channel.Secrets = append(channel.Secrets, secret)
 
 	db := s.Db.WithContext(ctx)
@@ -119,9 +187,22 @@ func (s *SecretStoreServiceImpl) GetChannelByAlgoUse(ctx context.Context, algo s
 	return channels, findResult.Error
 }
 
+// DeleteChannel deletes the channel along with its keys, each key leaves a tombstone.
 func (s *SecretStoreServiceImpl) DeleteChannel(ctx context.Context, channelId uint) error {
+	channel, err := s.GetChannel(ctx, channelId)
+	if err != nil {
+		return err
+	}
+	err = s.purgeSecrets(ctx, channel.Name, channel.Secrets)
+	if err != nil {
+		return err
+	}
 	db := s.Db.WithContext(ctx)
-	return db.Delete(&models.SecretChannelModel{}, channelId).Error
+	err = db.Delete(&models.SecretChannelModel{}, channelId).Error
+	if err != nil {
+		return err
+	}
+	return s.destroyPendingKeys(ctx)
 }
 
 func (s *SecretStoreServiceImpl) RenewSecret(ctx context.Context, channelId uint) error {
@@ -137,14 +218,9 @@ func (s *SecretStoreServiceImpl) RenewSecret(ctx context.Context, channelId uint
 	}
 	currentTime := time.Now()
 	expiry := time.Duration(channel.ValidityDay) * time.Duration(24) * time.Hour
-	for _, secret := range channel.Secrets {
-		if secret.ExpiresAt.After(currentTime) {
-			secret.ExpiresAt = currentTime
-			replace := db.Save(secret)
-			if replace.Error != nil {
-				return replace.Error
-			}
-		}
+	err := s.retireSecrets(ctx, channel.Secrets, currentTime)
+	if err != nil {
+		return err
 	}
 	newSecret := &models.SecretModel{
 		KeyId:     uuid.New().String(),
@@ -154,19 +230,57 @@ func (s *SecretStoreServiceImpl) RenewSecret(ctx context.Context, channelId uint
 		Algorithm: channel.Algorithm,
 		Use:       channel.Use,
 	}
-	var err error
-	newSecret.Value, err = s.createSecret(channel.Algorithm)
+	err = s.createSecret(ctx, newSecret)
+	if err != nil {
+		return err
+	}
+	err = s.certifySecret(ctx, channel, newSecret)
 	if err != nil {
 		return err
 	}
 	return db.Save(newSecret).Error
 }
 
-func (s *SecretStoreServiceImpl) createSecret(algorithm string) ([]byte, error) {
+func (s *SecretStoreServiceImpl) retireSecrets(ctx context.Context, secrets []*models.SecretModel, retireAt time.Time) error {
+	db := s.Db.WithContext(ctx)
+	for _, secret := range secrets {
+		if secret.ExpiresAt.After(retireAt) {
+			secret.ExpiresAt = retireAt
+			replace := db.Save(secret)
+			if replace.Error != nil {
+				return replace.Error
+			}
+		}
+	}
+	return nil
+}
+
+// createSecret generates the key in the configured custody. Symmetric and encryption keys are
+// always held in the database, as they are not used for signing a digest.
+func (s *SecretStoreServiceImpl) createSecret(ctx context.Context, secret *models.SecretModel) error {
+	custody := IKeyCustody(s.databaseCustody())
+	if s.Custody != nil && secret.Use == KeyUseSignature && !IsSymmetricAlgorithm(secret.Algorithm) {
+		custody = s.Custody
+	}
+	secret.Custody = custody.Name()
+	return custody.GenerateKey(ctx, secret)
+}
+
+// generateKeyMaterial returns the PKCS8 encoded private key for asymmetric algorithms, and the raw
+// key for symmetric ones. Symmetric keys are never shorter than the output of the hash used. PS keys
+// used to be generated as ECDSA keys, which can not make a PSS signature, the channels created then
+// get an RSA key with their next RenewSecret.
+func generateKeyMaterial(algorithm string) ([]byte, error) {
 	var key interface{}
 	var err error
 
 	switch algorithm {
+	case string(jose.HS256):
+		return GenerateRandomBytes(32)
+	case string(jose.HS384):
+		return GenerateRandomBytes(48)
+	case string(jose.HS512):
+		return GenerateRandomBytes(64)
 	case string(jose.RS256):
 		key, err = rsa.GenerateKey(rand.Reader, 1024)
 	case string(jose.RS384):
@@ -174,11 +288,21 @@ func (s *SecretStoreServiceImpl) createSecret(algorithm string) ([]byte, error)
 	case string(jose.RS512):
 		key, err = rsa.GenerateKey(rand.Reader, 4096)
 	case string(jose.PS256):
-		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
 	case string(jose.PS384):
-		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
 	case string(jose.PS512):
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case string(jose.ES256):
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case string(jose.ES384):
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case string(jose.ES512):
 		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case string(jose.RSA_OAEP_256):
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case string(jose.ECDH_ES), string(jose.ECDH_ES_A128KW), string(jose.ECDH_ES_A192KW), string(jose.ECDH_ES_A256KW):
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	default:
 		return nil, fmt.Errorf("algorithm %s is not supported", algorithm)
 	}
@@ -192,3 +316,132 @@ func (s *SecretStoreServiceImpl) createSecret(algorithm string) ([]byte, error)
 	}
 	return data, nil
 }
+
+func (s *SecretStoreServiceImpl) databaseCustody() *DatabaseKeyCustody {
+	return NewDatabaseKeyCustody(s.TextDec, s.TextEnc)
+}
+
+// parseSecret returns the private key of secrets held in the database. Keys held by an external
+// custody never leave it, only their public key is returned.
+func (s *SecretStoreServiceImpl) parseSecret(ctx context.Context, secret *models.SecretModel) (interface{}, error) {
+	if isDatabaseCustody(secret) {
+		return s.databaseCustody().PrivateKey(ctx, secret)
+	}
+	custody, err := s.custodyOf(secret)
+	if err != nil {
+		return nil, err
+	}
+	return custody.PublicKey(ctx, secret)
+}
+
+// opaqueSigner signs with the secret through its custody, the private key is never loaded.
+func (s *SecretStoreServiceImpl) opaqueSigner(ctx context.Context, secret *models.SecretModel) (jose.OpaqueSigner, error) {
+	custody, err := s.custodyOf(secret)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := custody.PublicKey(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	signer := &custodySigner{ctx: ctx, custody: custody, secret: secret, publicKey: publicKey}
+	return cryptosigner.Opaque(signer), nil
+}
+
+func isDatabaseCustody(secret *models.SecretModel) bool {
+	return secret.Custody == "" || secret.Custody == CustodyDatabase
+}
+
+func (s *SecretStoreServiceImpl) custodyOf(secret *models.SecretModel) (IKeyCustody, error) {
+	if isDatabaseCustody(secret) {
+		return s.databaseCustody(), nil
+	}
+	if s.Custody != nil && s.Custody.Name() == secret.Custody {
+		return s.Custody, nil
+	}
+	return nil, fmt.Errorf("custody %s of secret %s is not available", secret.Custody, secret.KeyId)
+}
+
+// EncryptSecrets envelope encrypts all secrets stored in plain, it returns the number of secrets
+// encrypted. It is meant to be run once after upgrading, running it again is harmless.
+func (s *SecretStoreServiceImpl) EncryptSecrets(ctx context.Context) (int, error) {
+	db := s.Db.WithContext(ctx)
+	secrets := make([]models.SecretModel, 0)
+	findResult := db.Where("custody is null or custody in ?", []string{"", CustodyDatabase}).
+		Find(&secrets, "wrapped_key is null or wrapped_key = ?", "")
+	if findResult.Error != nil {
+		return 0, findResult.Error
+	}
+	custody := s.databaseCustody()
+	for i, secret := range secrets {
+		material, err := custody.Open(ctx, &secret)
+		if err != nil {
+			return i, err
+		}
+		err = custody.Seal(ctx, &secret, material)
+		if err != nil {
+			return i, err
+		}
+		err = db.Model(&secret).UpdateColumns(models.SecretModel{
+			Value:      secret.Value,
+			WrappedKey: secret.WrappedKey,
+		}).Error
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(secrets), nil
+}
+
+// DecryptRequestObject opens a JWE encrypted to one of the published encryption keys. The key is
+// chosen by the kid of the JWE header, when it is absent all keys of the header alg are tried. A
+// key is never used with an alg other than the one of its channel.
+func (s *SecretStoreServiceImpl) DecryptRequestObject(ctx context.Context, token string) ([]byte, error) {
+	jwe, err := jose.ParseEncrypted(token)
+	if err != nil {
+		return nil, err
+	}
+	db := s.Db.WithContext(ctx)
+	secrets := make([]models.SecretModel, 0)
+	query := db.Where("key_usage = ? and algorithm = ?", KeyUseEncryption, jwe.Header.Algorithm)
+	if jwe.Header.KeyID != "" {
+		query = query.Where("key_id = ?", jwe.Header.KeyID)
+	}
+	findResult := query.Find(&secrets)
+	if findResult.Error != nil {
+		return nil, findResult.Error
+	}
+	if findResult.RowsAffected < 1 {
+		return nil, fmt.Errorf("no encryption key found with kid %s", jwe.Header.KeyID)
+	}
+	for _, secret := range secrets {
+		key, err := s.parseSecret(ctx, &secret)
+		if err != nil {
+			continue
+		}
+		payload, err := jwe.Decrypt(key)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to decrypt request object")
+}
+
+func IsEncryptionAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case string(jose.RSA_OAEP_256), string(jose.ECDH_ES), string(jose.ECDH_ES_A128KW),
+		string(jose.ECDH_ES_A192KW), string(jose.ECDH_ES_A256KW):
+		return true
+	default:
+		return false
+	}
+}
+
+func IsSymmetricAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case string(jose.HS256), string(jose.HS384), string(jose.HS512):
+		return true
+	default:
+		return false
+	}
+}
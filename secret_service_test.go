@@ -2,12 +2,25 @@ package core
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/identityOrg/oidcsdk"
+	"github.com/identityOrg/oidcsdk/impl/strategies"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 	"testing"
+	"time"
 )
 
 func TestNewSecretStoreServiceImpl(t *testing.T) {
-	secretService := NewSecretStoreServiceImpl(TestDb)
+	enc := NewNoOpTextEncrypt()
+	secretService := NewSecretStoreServiceImpl(TestDb, enc, enc)
 	ctx := context.Background()
 	secretService.Db = beginTransaction(context.Background(), secretService.Db)
 	var channelId uint
@@ -54,5 +67,173 @@ func TestNewSecretStoreServiceImpl(t *testing.T) {
 			}
 		}
 	})
+	t.Run("symmetric channel", func(t *testing.T) {
+		_, err := secretService.CreateChannel(ctx, "hmac", "HS256", "sig", 10)
+		if assert.NoError(t, err) {
+			secrets, err := secretService.GetAllSecrets(ctx)
+			if assert.NoError(t, err) {
+				assert.Equal(t, 2, len(secrets.Keys))
+			}
+			symmetric, err := secretService.GetSymmetricSecrets(ctx)
+			if assert.NoError(t, err) && assert.Equal(t, 1, len(symmetric.Keys)) {
+				assert.Equal(t, "HS256", symmetric.Keys[0].Algorithm)
+				assert.Equal(t, 32, len(symmetric.Keys[0].Key.([]byte)))
+			}
+		}
+	})
+	t.Run("encryption channel", func(t *testing.T) {
+		_, err := secretService.CreateChannel(ctx, "enc-rsa", "RSA-OAEP-256", "sig", 10)
+		assert.Error(t, err)
+		for _, alg := range []string{"RSA-OAEP-256", "ECDH-ES+A128KW"} {
+			channelId, err := secretService.CreateChannel(ctx, "enc-"+alg, alg, "enc", 10)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			channel, err := secretService.GetChannel(ctx, channelId)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			secrets, err := secretService.GetAllSecrets(ctx)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			keys := secrets.Key(channel.Secrets[0].KeyId)
+			if assert.Equal(t, 1, len(keys)) {
+				publicKey := keys[0].Public()
+				recipient := jose.Recipient{Algorithm: jose.KeyAlgorithm(alg), Key: &publicKey}
+				encrypter, err := jose.NewEncrypter(jose.A128GCM, recipient, nil)
+				if assert.NoError(t, err) {
+					jwe, err := encrypter.Encrypt([]byte("request"))
+					if assert.NoError(t, err) {
+						token, _ := jwe.CompactSerialize()
+						payload, err := secretService.DecryptRequestObject(ctx, token)
+						if assert.NoError(t, err) {
+							assert.Equal(t, "request", string(payload))
+						}
+					}
+				}
+			}
+		}
+	})
+	t.Run("encrypted at rest", func(t *testing.T) {
+		secret := &models.SecretModel{}
+		findResult := secretService.Db.Find(secret, "channel_id = ?", channelId)
+		if assert.NoError(t, findResult.Error) {
+			assert.NotEmpty(t, secret.WrappedKey)
+			_, err := x509.ParsePKCS8PrivateKey(secret.Value)
+			assert.Error(t, err)
+		}
+	})
+	t.Run("encrypt existing secrets", func(t *testing.T) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		value, _ := x509.MarshalPKCS8PrivateKey(key)
+		legacy := &models.SecretModel{KeyId: "legacy", Algorithm: "ES256", Use: "sig", Value: value, ChannelId: channelId}
+		if assert.NoError(t, secretService.Db.Save(legacy).Error) {
+			count, err := secretService.EncryptSecrets(ctx)
+			if assert.NoError(t, err) {
+				assert.Equal(t, 1, count)
+				secrets, err := secretService.GetAllSecrets(ctx)
+				if assert.NoError(t, err) && assert.Equal(t, 1, len(secrets.Key("legacy"))) {
+					assert.Equal(t, key.D, secrets.Key("legacy")[0].Key.(*ecdsa.PrivateKey).D)
+				}
+			}
+			secretService.Db.Delete(legacy)
+		}
+	})
+	t.Run("external custody", func(t *testing.T) {
+		custody := &memoryKeyCustody{keys: map[string]*ecdsa.PrivateKey{}}
+		secretService.Custody = custody
+		defer func() { secretService.Custody = NewDatabaseKeyCustody(enc, enc) }()
+		channelId, err := secretService.CreateChannel(ctx, "external", "ES256", "sig", 10)
+		if assert.NoError(t, err) {
+			channel, err := secretService.GetChannel(ctx, channelId)
+			if assert.NoError(t, err) {
+				secret := channel.Secrets[0]
+				assert.Equal(t, "memory", secret.Custody)
+				assert.Equal(t, secret.KeyId, string(secret.Value))
+				secrets, err := secretService.GetAllSecrets(ctx)
+				if assert.NoError(t, err) && assert.Equal(t, 1, len(secrets.Key(secret.KeyId))) {
+					jwk := secrets.Key(secret.KeyId)[0]
+					assert.True(t, jwk.IsPublic())
+					assert.Equal(t, custody.keys[secret.KeyId].PublicKey, *jwk.Key.(*ecdsa.PublicKey))
+				}
+				secrets, err = NewSigningSecretStore(secretService).GetAllSecrets(ctx)
+				if assert.NoError(t, err) && assert.Equal(t, 1, len(secrets.Key(secret.KeyId))) {
+					signingKey := jose.SigningKey{Algorithm: jose.ES256, Key: secrets.Key(secret.KeyId)[0]}
+					signer, err := jose.NewSigner(signingKey, nil)
+					if assert.NoError(t, err) {
+						jws, err := signer.Sign([]byte("payload"))
+						if assert.NoError(t, err) {
+							_, err = jws.Verify(&custody.keys[secret.KeyId].PublicKey)
+							assert.NoError(t, err)
+						}
+					}
+				}
+				// as wired: the token strategy signs through oidcsdk.ISecretStore, the JWKS endpoint
+				// publishes the ISecretStoreService keys
+				var signingStore oidcsdk.ISecretStore = NewSigningSecretStore(secretService)
+				var publishingStore ISecretStoreService = secretService
+				strategy := strategies.NewDefaultStrategy(signingStore, &oidcsdk.Config{Issuer: "https://localhost"})
+				client := models.ServiceProviderModel{
+					ClientID: "client",
+					Metadata: &models.ServiceProviderMetadata{IdTokenSignedResponseAlg: "ES256"},
+				}
+				profile := oidcsdk.RequestProfile{}
+				profile.SetUsername("user")
+				idToken, err := strategy.GenerateIDToken(ctx, profile, client, time.Now().Add(time.Minute), nil, oidcsdk.Tokens{})
+				if !assert.NoError(t, err) {
+					return
+				}
+				published, err := publishingStore.GetAllSecrets(ctx)
+				if assert.NoError(t, err) && assert.Equal(t, 1, len(published.Key(secret.KeyId))) {
+					jwk := published.Key(secret.KeyId)[0].Public()
+					assert.True(t, jwk.Valid())
+					parsed, err := jwt.ParseSigned(idToken)
+					if assert.NoError(t, err) {
+						claims := jwt.Claims{}
+						assert.NoError(t, parsed.Claims(jwk.Key, &claims))
+						assert.Equal(t, "user", claims.Subject)
+					}
+				}
+			}
+		}
+	})
 	rollbackTransaction(secretService.Db)
 }
+
+type memoryKeyCustody struct {
+	keys map[string]*ecdsa.PrivateKey
+	// destroyFailures makes as many DestroyKey calls fail
+	destroyFailures int
+}
+
+func (m *memoryKeyCustody) Name() string {
+	return "memory"
+}
+
+func (m *memoryKeyCustody) GenerateKey(_ context.Context, secret *models.SecretModel) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	m.keys[secret.KeyId] = key
+	secret.Value = []byte(secret.KeyId)
+	return nil
+}
+
+func (m *memoryKeyCustody) PublicKey(_ context.Context, secret *models.SecretModel) (crypto.PublicKey, error) {
+	return m.keys[string(secret.Value)].Public(), nil
+}
+
+func (m *memoryKeyCustody) Sign(_ context.Context, secret *models.SecretModel, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return m.keys[string(secret.Value)].Sign(rand.Reader, digest, opts)
+}
+
+func (m *memoryKeyCustody) DestroyKey(_ context.Context, secret *models.SecretModel) error {
+	if m.destroyFailures > 0 {
+		m.destroyFailures--
+		return errors.New("custody unavailable")
+	}
+	delete(m.keys, string(secret.Value))
+	return nil
+}
@@ -22,6 +22,7 @@ func (ts *TokenStoreServiceImpl) StoreTokenProfile(ctx context.Context, reqId st
 	txn := ts.Db.WithContext(ctx)
 	token := &models.TokensModel{
 		RequestID:      reqId,
+		Username:       profile.GetUsername(),
 		ACSignature:    convertToNullString(signatures.GetACSignature()),
 		ATSignature:    convertToNullString(signatures.GetATSignature()),
 		RTSignature:    convertToNullString(signatures.GetRTSignature()),
@@ -125,3 +126,15 @@ func (ts *TokenStoreServiceImpl) InvalidateWithRequestID(ctx context.Context, re
 	}
 	return txn.Save(token).Error
 }
+
+// RevokeUserTokens expires the access and refresh tokens issued to the user, after the password of
+// the user was reset. Tokens stored before the username was recorded with them are not found.
+func (ts *TokenStoreServiceImpl) RevokeUserTokens(ctx context.Context, username string) error {
+	if username == "" {
+		return nil
+	}
+	txn := ts.Db.WithContext(ctx)
+	expired := sql.NullTime{Valid: true, Time: time.Now().Add(-10)}
+	return txn.Model(&models.TokensModel{}).Where("username = ?", username).
+		Updates(map[string]interface{}{"at_expiry": expired, "rt_expiry": expired}).Error
+}
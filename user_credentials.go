@@ -0,0 +1,65 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+)
+
+// ListCredentials returns the credentials of the user without their secret values.
+func (u *UserStoreServiceImpl) ListCredentials(ctx context.Context, id uint) ([]models.UserCredentials, error) {
+	if _, err := u.GetUser(ctx, id); err != nil {
+		return nil, err
+	}
+	var creds []models.UserCredentials
+	err := u.Db.WithContext(ctx).Order("cred_type, id").Find(&creds, "user_id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range creds {
+		creds[i].Value = ""
+		creds[i].PublicKey = nil
+		creds[i].LastTimeStep = 0
+	}
+	return creds, nil
+}
+
+func (u *UserStoreServiceImpl) RenameCredential(ctx context.Context, id uint, credId uint, name string) error {
+	result := u.Db.WithContext(ctx).Model(&models.UserCredentials{}).Where("id = ? and user_id = ?", credId, id).
+		Update("name", name)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return fmt.Errorf("credential %d not found for user %d", credId, id)
+	}
+	return nil
+}
+
+// RemoveCredential deletes a credential of the user. A user has exactly one password, which is
+// replaced with SetPassword and can not be removed. Removing the recovery codes credential removes the
+// codes too.
+func (u *UserStoreServiceImpl) RemoveCredential(ctx context.Context, id uint, credId uint) error {
+	db := u.Db.WithContext(ctx)
+	cred := &models.UserCredentials{}
+	result := db.Find(cred, "id = ? and user_id = ?", credId, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return fmt.Errorf("credential %d not found for user %d", credId, id)
+	}
+	if cred.Type == CredTypePassword {
+		return errors.New("password credential can not be removed")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if cred.Type == CredTypeRecoveryCodes {
+			if err := tx.Delete(&models.UserRecoveryCode{}, "user_id = ?", id).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(cred).Error
+	})
+}
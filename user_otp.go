@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	OTPPurposeEmailChange = "email-change"
+	OTPPurposeLogin       = "login"
+	OTPPurposeReset       = "reset"
+	OTPPurposePhoneVerify = "phone-verify"
+)
+
+const (
+	defaultOTPTTL         = 10 * time.Minute
+	defaultOTPMaxAttempts = 5
+)
+
+var (
+	ErrInvalidOTP    = errors.New("invalid or expired one-time code")
+	ErrOTPKeyMissing = errors.New("one-time codes need Config.EncryptionKey")
+)
+
+// GenerateUserOTP issues a numeric code for the purpose, replacing the pending code of the user for
+// the same purpose. Only a keyed hash of the code is stored, it expires after Config.OTPTTL.
+func (u *UserStoreServiceImpl) GenerateUserOTP(ctx context.Context, id uint, purpose string, length uint8) (code string, err error) {
+	if !validOTPPurpose(purpose) {
+		return "", fmt.Errorf("invalid otp purpose %s", purpose)
+	}
+	code, err = GenerateRandom(true, length)
+	if err != nil {
+		return "", err
+	}
+	valueHash, err := u.hashOTP(id, purpose, code)
+	if err != nil {
+		return "", err
+	}
+	otp := &models.UserOTP{
+		ValueHash: valueHash,
+		UserID:    id,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(u.otpTTL()),
+	}
+	db := u.Db.WithContext(ctx)
+	err = db.Delete(&models.UserOTP{}, "user_id = ? and purpose = ?", id, purpose).Error
+	if err != nil {
+		return "", err
+	}
+	err = db.Create(otp).Error
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// DeliverUserOTP issues a code for the purpose and sends it to the user over the channel. Codes for
+// an email change or a phone verification go to the address waiting for confirmation.
+func (u *UserStoreServiceImpl) DeliverUserOTP(ctx context.Context, id uint, purpose string, channel string) error {
+	if u.Notifier == nil {
+		return errors.New("no notifier configured")
+	}
+	user, err := u.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	to := ""
+	switch channel {
+	case NotificationChannelEmail:
+		to = user.EmailAddress
+		if purpose == OTPPurposeEmailChange {
+			to = user.TempEmailAddress
+		}
+	case NotificationChannelSMS:
+		if purpose == OTPPurposePhoneVerify {
+			to = user.TempPhoneNumber
+		} else if user.Metadata != nil {
+			to = user.Metadata.GetPhoneNumber()
+		}
+	default:
+		return fmt.Errorf("unsupported notification channel %s", channel)
+	}
+	if to == "" {
+		return fmt.Errorf("no %s address to notify user %d", channel, id)
+	}
+	code, err := u.GenerateUserOTP(ctx, id, purpose, 6)
+	if err != nil {
+		return err
+	}
+	return u.Notifier.NotifyOTP(ctx, user, channel, to, purpose, code, time.Now().Add(u.otpTTL()))
+}
+
+// ValidateOTP checks the pending code of the user for the purpose. A code is used once, and is
+// dropped when it expires or after Config.OTPMaxAttempts wrong attempts.
+func (u *UserStoreServiceImpl) ValidateOTP(ctx context.Context, id uint, purpose string, code string) (err error) {
+	otp := &models.UserOTP{}
+	db := u.Db.WithContext(ctx)
+	findResult := db.Find(otp, "user_id = ? and purpose = ?", id, purpose)
+	if findResult.Error != nil {
+		return findResult.Error
+	}
+	if findResult.RowsAffected != 1 {
+		return ErrInvalidOTP
+	}
+	maxAttempts := u.otpMaxAttempts()
+	if !otp.ExpiresAt.After(time.Now()) || otp.Attempts >= maxAttempts {
+		if err = db.Delete(otp).Error; err != nil {
+			return err
+		}
+		return ErrInvalidOTP
+	}
+	valueHash, err := u.hashOTP(id, purpose, code)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(otp.ValueHash), []byte(valueHash)) {
+		// counted in the database, concurrent guesses can not share an attempt
+		updateResult := db.Model(&models.UserOTP{}).Where("id = ? and attempts < ?", otp.ID, maxAttempts).
+			UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+		if updateResult.Error != nil {
+			return updateResult.Error
+		}
+		if updateResult.RowsAffected == 1 && otp.Attempts+1 >= maxAttempts {
+			if err = db.Delete(otp).Error; err != nil {
+				return err
+			}
+		}
+		return ErrInvalidOTP
+	}
+	deleteResult := db.Where("attempts < ?", maxAttempts).Delete(otp)
+	if deleteResult.Error != nil {
+		return deleteResult.Error
+	}
+	if deleteResult.RowsAffected != 1 {
+		// validated concurrently, or out of attempts meanwhile
+		return ErrInvalidOTP
+	}
+	return nil
+}
+
+func (u *UserStoreServiceImpl) otpMaxAttempts() uint {
+	if u.Config.OTPMaxAttempts > 0 {
+		return u.Config.OTPMaxAttempts
+	}
+	return defaultOTPMaxAttempts
+}
+
+func (u *UserStoreServiceImpl) otpTTL() time.Duration {
+	if u.Config.OTPTTL > 0 {
+		return u.Config.OTPTTL
+	}
+	return defaultOTPTTL
+}
+
+// hashOTP binds the code to the user and the purpose. Codes are short, so the hash is keyed with
+// the encryption key to keep the stored hashes from being reversed by enumeration, without a key
+// no code is issued or checked.
+func (u *UserStoreServiceImpl) hashOTP(id uint, purpose string, code string) (string, error) {
+	if u.Config.EncryptionKey == "" {
+		return "", ErrOTPKeyMissing
+	}
+	mac := hmac.New(sha256.New, []byte(u.Config.EncryptionKey))
+	_, _ = fmt.Fprintf(mac, "%d:%s:%s", id, purpose, code)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func validOTPPurpose(purpose string) bool {
+	switch purpose {
+	case OTPPurposeEmailChange, OTPPurposeLogin, OTPPurposeReset, OTPPurposePhoneVerify:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRecoveryCodeCount = 10
+	recoveryCodeLength       = 10
+	// recoveryCodeAlphabet has 32 symbols so that random bytes map to it without bias, and leaves
+	// out the ones easily mistaken for each other
+	recoveryCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+var ErrRecoveryKeyMissing = errors.New("recovery codes need Config.EncryptionKey")
+
+// GenerateRecoveryCodes replaces the recovery codes of the user with a new set of
+// Config.RecoveryCodeCount codes. The codes are returned once, only their hashes are stored.
+func (u *UserStoreServiceImpl) GenerateRecoveryCodes(ctx context.Context, id uint) (codes []string, err error) {
+	count := u.Config.RecoveryCodeCount
+	if count == 0 {
+		count = defaultRecoveryCodeCount
+	}
+	records := make([]*models.UserRecoveryCode, count)
+	for i := range records {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codeHash, err := u.hashRecoveryCode(id, code)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		records[i] = &models.UserRecoveryCode{UserID: id, CodeHash: codeHash}
+	}
+	err = u.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := updateCredential(tx, id, "", CredTypeRecoveryCodes, "hmac-sha256")
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(&models.UserRecoveryCode{}, "user_id = ?", id).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ValidateRecoveryCode consumes an unused recovery code of the user. Wrong codes count as invalid
+// attempts on the recovery codes credential, which gets blocked like the other credentials. A valid
+// code clears the count.
+func (u *UserStoreServiceImpl) ValidateRecoveryCode(ctx context.Context, id uint, code string) error {
+	codeHash, err := u.hashRecoveryCode(id, code)
+	if err != nil {
+		return err
+	}
+	user, err := u.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user.Inactive {
+		return errors.New("user inactive")
+	}
+	db := u.Db.WithContext(ctx)
+	cred := &models.UserCredentials{}
+	credResult := db.Find(cred, "user_id = ? and cred_type = ?", id, CredTypeRecoveryCodes)
+	if credResult.Error != nil {
+		return credResult.Error
+	}
+	if credResult.RowsAffected != 1 {
+		return fmt.Errorf("recovery codes not generated for user %d", id)
+	}
+	if cred.Bocked {
+		return errors.New("credential blocked")
+	}
+	now := time.Now()
+	result := db.Model(&models.UserRecoveryCode{}).
+		Where("user_id = ? and code_hash = ? and used_at is null", id, codeHash).
+		Update("used_at", &now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		err = countInvalidAttempt(db, cred.ID, u.Config.MaxInvalidLoginAttempt, u.Config.InvalidAttemptWindow)
+		if err != nil {
+			return err
+		}
+		return errors.New("invalid recovery code")
+	}
+	if cred.InvalidAttemptCount > 0 || cred.FirstInvalidAttempt != nil {
+		return db.Model(cred).Updates(map[string]interface{}{"invalid_attempt_count": 0, "first_invalid_attempt": nil}).Error
+	}
+	return nil
+}
+
+// countInvalidAttempt counts an invalid attempt on the credential like
+// UserCredentials.IncrementInvalidAttempt, with conditional updates in the database so that
+// concurrent guesses can not share an attempt. An attempt after the window starts a new one.
+func countInvalidAttempt(db *gorm.DB, credId uint, maxAllowed uint, window time.Duration) error {
+	now := time.Now()
+	restart := db.Model(&models.UserCredentials{}).
+		Where("id = ? and blocked = ? and (first_invalid_attempt is null or first_invalid_attempt < ?)", credId, false, now.Add(-window)).
+		Updates(map[string]interface{}{"first_invalid_attempt": now, "invalid_attempt_count": 1, "blocked": maxAllowed == 0})
+	if restart.Error != nil {
+		return restart.Error
+	}
+	if restart.RowsAffected == 0 {
+		err := db.Model(&models.UserCredentials{}).Where("id = ? and blocked = ?", credId, false).
+			UpdateColumn("invalid_attempt_count", gorm.Expr("invalid_attempt_count + 1")).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Model(&models.UserCredentials{}).Where("id = ? and invalid_attempt_count > ?", credId, maxAllowed).
+		UpdateColumn("blocked", true).Error
+}
+
+func (u *UserStoreServiceImpl) GetRemainingRecoveryCodes(ctx context.Context, id uint) (remaining int, err error) {
+	var count int64
+	err = u.Db.WithContext(ctx).Model(&models.UserRecoveryCode{}).
+		Where("user_id = ? and used_at is null", id).Count(&count).Error
+	return int(count), err
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, the way codes are usually typed back. Without a
+// key the hashes of the short codes could be brute forced offline, so a key is required.
+func (u *UserStoreServiceImpl) hashRecoveryCode(id uint, code string) (string, error) {
+	if u.Config.EncryptionKey == "" {
+		return "", ErrRecoveryKeyMissing
+	}
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	mac := hmac.New(sha256.New, []byte(u.Config.EncryptionKey))
+	_, _ = fmt.Fprintf(mac, "%d:recovery:%s", id, normalized)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// generateRecoveryCode returns a code like "7KQ2M-XH4PA".
+func generateRecoveryCode() (string, error) {
+	random, err := GenerateRandomBytes(recoveryCodeLength)
+	if err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, recoveryCodeLength+1)
+	for i, b := range random {
+		if i == recoveryCodeLength/2 {
+			code = append(code, '-')
+		}
+		code = append(code, recoveryCodeAlphabet[int(b)%len(recoveryCodeAlphabet)])
+	}
+	return string(code), nil
+}
@@ -7,19 +7,33 @@ import (
 	"fmt"
 	"github.com/identityOrg/cerberus-core/models"
 	"github.com/identityOrg/oidcsdk"
-	"github.com/pquerna/otp/totp"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
-	"image"
+	"regexp"
+	"time"
 )
 
+var phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
 type UserStoreServiceImpl struct {
-	Db     *gorm.DB
-	Config *Config
+	Db       *gorm.DB
+	Config   *Config
+	TextEnc  ITextEncrypts
+	TextDec  ITextDecrypts
+	Hasher   IPasswordHasher
+	Policies IPasswordPolicyProvider
+	Notifier INotificationService
 }
 
-func NewUserStoreServiceImpl(db *gorm.DB, config *Config) *UserStoreServiceImpl {
-	return &UserStoreServiceImpl{Db: db, Config: config}
+func NewUserStoreServiceImpl(db *gorm.DB, config *Config, dec ITextDecrypts, enc ITextEncrypts, notifier INotificationService) *UserStoreServiceImpl {
+	return &UserStoreServiceImpl{
+		Db:       db,
+		Config:   config,
+		TextEnc:  enc,
+		TextDec:  dec,
+		Hasher:   NewPasswordHasher(config),
+		Policies: NewPasswordPolicyEngine(config.PasswordPolicy),
+		Notifier: notifier,
+	}
 }
 
 func (u *UserStoreServiceImpl) FindUserByUsername(ctx context.Context, username string) (*models.UserModel, error) {
@@ -82,6 +96,9 @@ func (u *UserStoreServiceImpl) DeactivateUser(ctx context.Context, id uint) erro
 	return u.updateStatus(ctx, id, true)
 }
 
+// ValidatePassword checks the password of the user. A correct password that has expired or has been
+// flagged for change fails with a *PasswordChangeRequiredError, so the login can move on to a
+// change of password.
 func (u *UserStoreServiceImpl) ValidatePassword(ctx context.Context, id uint, password string) error {
 	user := &models.UserModel{}
 	user.ID = id
@@ -107,95 +124,90 @@ func (u *UserStoreServiceImpl) ValidatePassword(ctx context.Context, id uint, pa
 	if cred.Bocked {
 		return errors.New("credential blocked")
 	}
-	err := bcrypt.CompareHashAndPassword([]byte(cred.Value), []byte(password))
+	matched, err := u.Hasher.Verify(cred.Value, password)
 	if err != nil {
+		return err
+	}
+	if !matched {
 		cred.IncrementInvalidAttempt(u.Config.MaxInvalidLoginAttempt, u.Config.InvalidAttemptWindow)
 		db.Save(cred)
 		return errors.New("password mismatch")
 	}
-	return nil
-}
-
-func (u *UserStoreServiceImpl) SetPassword(ctx context.Context, id uint, password string) (err error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), u.Config.PasswordCost)
-	if err != nil {
-		return
+	if u.Hasher.NeedsRehash(cred.Value) {
+		// the login must not fail if the upgrade does, it is retried on the next login
+		if hashed, err := u.Hasher.Hash(password); err == nil {
+			db.Model(cred).Updates(map[string]interface{}{"value": hashed, "algorithm": passwordHashAlgorithm(hashed)})
+		}
+	}
+	if cred.MustChange {
+		return &PasswordChangeRequiredError{Reason: PasswordChangeRequested}
+	}
+	if u.Config.PasswordMaxAge > 0 && cred.Age() > u.Config.PasswordMaxAge {
+		return &PasswordChangeRequiredError{Reason: PasswordChangeExpired}
 	}
-	return u.updateCredential(ctx, id, string(hashed), CredTypePassword)
+	return nil
 }
 
-func (u *UserStoreServiceImpl) GenerateTOTP(ctx context.Context, id uint, issuer string) (image.Image, string, error) {
-	user := &models.UserModel{}
-	user.ID = id
+// RequirePasswordChange flags the password of the user, the next successful login must be followed
+// by a change of password.
+func (u *UserStoreServiceImpl) RequirePasswordChange(ctx context.Context, id uint) error {
 	db := u.Db.WithContext(ctx)
-	result := db.Find(user)
+	result := db.Model(&models.UserCredentials{}).Where("user_id = ? and cred_type = ?", id, CredTypePassword).
+		Update("must_change", true)
 	if result.Error != nil {
-		return nil, "", result.Error
+		return result.Error
 	}
 	if result.RowsAffected != 1 {
-		return nil, "", fmt.Errorf("user not found with id %d", id)
-	}
-	opt := totp.GenerateOpts{
-		Issuer:      issuer,
-		AccountName: user.Username,
-		SecretSize:  u.Config.TOTPSecretLength,
+		return fmt.Errorf("password not set for user %d", id)
 	}
-	key, err := totp.Generate(opt)
+	return nil
+}
+
+// SetPassword validates the password against the policy of the user before storing its hash. A
+// rejected password fails with a *PasswordPolicyError listing every violation.
+func (u *UserStoreServiceImpl) SetPassword(ctx context.Context, id uint, password string) (err error) {
+	user, err := u.GetUser(ctx, id)
 	if err != nil {
-		return nil, "", err
+		return
 	}
-	img, err := key.Image(200, 200)
+	policy, err := u.Policies.GetPasswordPolicy(ctx, user)
 	if err != nil {
-		return nil, "", err
+		return
 	}
-	err = u.updateCredential(ctx, id, key.Secret(), CredTypeTOTP)
+	violations, err := policy.Validate(user, password)
 	if err != nil {
-		return nil, "", err
-	}
-	return img, key.Secret(), nil
-}
-
-func (u *UserStoreServiceImpl) ValidateTOTP(ctx context.Context, id uint, code string) error {
-	user := &models.UserModel{}
-	user.ID = id
-	db := u.Db.WithContext(ctx)
-	findResult := db.Find(user)
-	if findResult.Error != nil {
-		return findResult.Error
+		return
 	}
-	err := findResult.Error
+	reused, err := u.passwordReused(ctx, id, password)
 	if err != nil {
-		return err
-	}
-	if user.Inactive {
-		return errors.New("user inactive")
+		return
 	}
-	cred := &models.UserCredentials{}
-	credResult := db.Find(cred, "user_id = ? and cred_type = ?", id, CredTypeTOTP)
-	if credResult.Error != nil {
-		return credResult.Error
+	if reused {
+		violations = append(violations, PasswordViolation{Rule: ViolationReused, Limit: u.Config.PasswordHistorySize})
 	}
-	if credResult.Error != nil {
-		return credResult.Error
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
 	}
-	if cred.Bocked {
-		return errors.New("credential blocked")
+	hashed, err := u.Hasher.Hash(password)
+	if err != nil {
+		return
 	}
-	valid := totp.Validate(code, cred.Value)
-	if !valid {
-		cred.IncrementInvalidAttempt(u.Config.MaxInvalidLoginAttempt, u.Config.InvalidAttemptWindow)
-		db.Save(cred)
-		err = errors.New("totp validation failed")
+	return u.replacePassword(ctx, id, hashed, passwordHashAlgorithm(hashed))
+}
+
+// ImportPasswordHash sets the password of a user migrated from another identity system with the
+// hash exported from it. The hash is verified as is and upgraded on the first successful login.
+func (u *UserStoreServiceImpl) ImportPasswordHash(ctx context.Context, id uint, algorithm string, hash string) error {
+	encoded, err := encodeForeignHash(algorithm, hash)
+	if err != nil {
 		return err
-	} else {
-		return nil
 	}
+	return u.replacePassword(ctx, id, encoded, algorithm)
 }
 
-func (u *UserStoreServiceImpl) updateCredential(ctx context.Context, id uint, hashed string, credType uint8) error {
+func updateCredential(db *gorm.DB, id uint, hashed string, credType uint8, algorithm string) error {
 	user := &models.UserModel{}
 	user.ID = id
-	db := u.Db.WithContext(ctx)
 	findResult := db.Find(user)
 	if findResult.Error != nil {
 		return findResult.Error
@@ -208,15 +220,21 @@ func (u *UserStoreServiceImpl) updateCredential(ctx context.Context, id uint, ha
 	if result.Error != nil {
 		return result.Error
 	}
+	now := time.Now()
 	if result.RowsAffected == 0 {
 		cred = models.UserCredentials{
-			UserID: id,
-			Type:   credType,
-			Value:  hashed,
-			Bocked: false,
+			UserID:    id,
+			Type:      credType,
+			Value:     hashed,
+			Algorithm: algorithm,
+			ChangedAt: &now,
+			Bocked:    false,
 		}
 	} else {
 		cred.Value = hashed
+		cred.Algorithm = algorithm
+		cred.ChangedAt = &now
+		cred.MustChange = false
 		cred.FirstInvalidAttempt = nil
 		cred.Bocked = false
 	}
@@ -262,30 +280,32 @@ func (u *UserStoreServiceImpl) ChangeUsername(ctx context.Context, id uint, user
 	return nil
 }
 
-func (u *UserStoreServiceImpl) InitiateEmailChange(ctx context.Context, id uint, email string) (code string, err error) {
+// InitiateEmailChange keeps the email address pending and sends a code to it. The email address of
+// the user is left as is until CompleteEmailChange confirms the code.
+func (u *UserStoreServiceImpl) InitiateEmailChange(ctx context.Context, id uint, email string) (err error) {
 	user := &models.UserModel{}
 	user.ID = id
 	db := u.Db.WithContext(ctx)
 	findResult := db.Find(user)
 	if findResult.Error != nil {
-		return "", findResult.Error
+		return findResult.Error
 	}
 	if findResult.Error != nil {
-		return "", findResult.Error
+		return findResult.Error
 	}
 	user.TempEmailAddress = email
 	updateResult := db.Save(user)
 	if updateResult.Error != nil {
-		return "", updateResult.Error
+		return updateResult.Error
 	}
 	if updateResult.RowsAffected != 1 {
-		return "", errors.New("update email initiation failed")
+		return errors.New("update email initiation failed")
 	}
-	return u.GenerateUserOTP(ctx, id, 6)
+	return u.DeliverUserOTP(ctx, id, OTPPurposeEmailChange, NotificationChannelEmail)
 }
 
 func (u *UserStoreServiceImpl) CompleteEmailChange(ctx context.Context, id uint, code string) error {
-	err := u.ValidateOTP(ctx, id, code)
+	err := u.ValidateOTP(ctx, id, OTPPurposeEmailChange, code)
 	if err != nil {
 		return err
 	}
@@ -311,6 +331,53 @@ func (u *UserStoreServiceImpl) CompleteEmailChange(ctx context.Context, id uint,
 	return nil
 }
 
+// InitiatePhoneVerification keeps the phone number pending and sends a code to it by SMS. The verified
+// number of the user is left as is until CompletePhoneVerification confirms the code.
+func (u *UserStoreServiceImpl) InitiatePhoneVerification(ctx context.Context, id uint, phoneNumber string) (err error) {
+	if !phoneNumberPattern.MatchString(phoneNumber) {
+		return fmt.Errorf("invalid phone number %s, expected E.164 format", phoneNumber)
+	}
+	db := u.Db.WithContext(ctx)
+	updateResult := db.Model(&models.UserModel{}).Where("id = ?", id).Update("temp_phone_number", phoneNumber)
+	if updateResult.Error != nil {
+		return updateResult.Error
+	}
+	if updateResult.RowsAffected != 1 {
+		return fmt.Errorf("user not found with id %d", id)
+	}
+	return u.DeliverUserOTP(ctx, id, OTPPurposePhoneVerify, NotificationChannelSMS)
+}
+
+// CompletePhoneVerification makes the pending phone number the verified phone_number claim of the user.
+// The code is only used up when a phone number is pending.
+func (u *UserStoreServiceImpl) CompletePhoneVerification(ctx context.Context, id uint, code string) error {
+	user, err := u.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user.TempPhoneNumber == "" {
+		return errors.New("no phone number pending verification")
+	}
+	err = u.ValidateOTP(ctx, id, OTPPurposePhoneVerify, code)
+	if err != nil {
+		return err
+	}
+	if user.Metadata == nil {
+		user.Metadata = &models.UserMetadata{}
+	}
+	user.Metadata.SetPhoneNumber(user.TempPhoneNumber)
+	user.Metadata.SetPhoneNumberVerified(true)
+	user.TempPhoneNumber = ""
+	updateResult := u.Db.WithContext(ctx).Save(user)
+	if updateResult.Error != nil {
+		return updateResult.Error
+	}
+	if updateResult.RowsAffected != 1 {
+		return errors.New("update phone verification failed")
+	}
+	return nil
+}
+
 func (u *UserStoreServiceImpl) CreateUser(ctx context.Context, username string, email string, metadata *models.UserMetadata) (id uint, err error) {
 	user := &models.UserModel{
 		Username:         username,
@@ -366,35 +433,28 @@ func (u *UserStoreServiceImpl) PatchUser(ctx context.Context, id uint, metadata
 func (u *UserStoreServiceImpl) DeleteUser(ctx context.Context, id uint) (err error) {
 	user := &models.UserModel{}
 	user.ID = id
-	db := u.Db.WithContext(ctx)
-	return db.Delete(user).Error
-}
-
-func (u *UserStoreServiceImpl) GenerateUserOTP(ctx context.Context, id uint, length uint8) (code string, err error) {
-	random, err := GenerateRandom(true, length)
-	if err != nil {
-		return "", err
-	}
-	otp := &models.UserOTP{
-		ValueHash: random,
-		UserID:    id,
-	}
-	db := u.Db.WithContext(ctx)
-	err = db.Save(otp).Error
-	if err != nil {
-		return "", err
-	}
-	return random, nil
+	return u.Db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, table := range userOwnedTables {
+			err := tx.Delete(table, "user_id = ?", id).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Delete(user).Error
+	})
 }
 
-func (u *UserStoreServiceImpl) ValidateOTP(ctx context.Context, id uint, code string) (err error) {
-	otp := &models.UserOTP{}
-	db := u.Db.WithContext(ctx)
-	findResult := db.Find(otp, "user_id = ? and hash_value = ?", id, code)
-	if findResult.Error != nil {
-		return findResult.Error
-	}
-	return db.Delete(otp).Error
+// userOwnedTables are the tables holding rows of a single user, deleted along with the user.
+var userOwnedTables = []interface{}{
+	&models.UserCredentials{},
+	&models.UserPasswordHistory{},
+	&models.UserResetToken{},
+	&models.UserOTP{},
+	&models.UserTOTPEnrollment{},
+	&models.UserRecoveryCode{},
+	&models.UserEmailVerification{},
+	&models.UserLoginToken{},
+	&models.UserWebAuthnChallenge{},
 }
 
 func (u *UserStoreServiceImpl) Authenticate(ctx context.Context, username string, credential []byte) (err error) {
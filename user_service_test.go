@@ -2,10 +2,19 @@ package core
 
 import (
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -61,7 +70,7 @@ func TestUserStoreServiceImpl_ActivateDeactivateUser(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("de-activate", func(t *testing.T) {
 		err := userStoreService.DeactivateUser(ctx, TestUser.ID)
@@ -87,7 +96,7 @@ func TestUserStoreServiceImpl_FindAllUser(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	allUser, count, err := userStoreService.FindAllUser(ctx, 0, 5)
 	assert.Nil(t, err)
@@ -104,12 +113,19 @@ func TestUserStoreServiceImpl_ValidatePassword(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("valid", func(t *testing.T) {
 		err := userStoreService.ValidatePassword(ctx, 1, "password")
 		assert.Nil(t, err)
 	})
+	t.Run("rehashed", func(t *testing.T) {
+		cred := &models.UserCredentials{}
+		userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", 1, CredTypePassword)
+		assert.True(t, strings.HasPrefix(cred.Value, "$argon2id$"))
+		err := userStoreService.ValidatePassword(ctx, 1, "password")
+		assert.Nil(t, err)
+	})
 	t.Run("invalid", func(t *testing.T) {
 		err := userStoreService.ValidatePassword(ctx, 1, "password1")
 		assert.Error(t, err)
@@ -127,6 +143,45 @@ func TestUserStoreServiceImpl_ValidatePassword(t *testing.T) {
 	rollbackTransaction(userStoreService.Db)
 }
 
+func TestUserStoreServiceImpl_ImportPasswordHash(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		MaxInvalidLoginAttempt: 3,
+		InvalidAttemptWindow:   5 * time.Minute,
+	}
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	digest := sha256.Sum256([]byte("pepper" + "password"))
+	pbkdf2Hash := base64.RawStdEncoding.EncodeToString(pbkdf2.Key([]byte("password"), []byte("salt"), 1000, 20, sha1.New))
+	hashes := map[string]string{
+		HashSHA256Salted: "pepper$" + hex.EncodeToString(digest[:]),
+		HashPBKDF2SHA1:   "$pbkdf2-sha1$i=1000,l=20$c2FsdA$" + pbkdf2Hash,
+	}
+	for algorithm, hash := range hashes {
+		t.Run(algorithm, func(t *testing.T) {
+			err := userStoreService.ImportPasswordHash(ctx, 1, algorithm, hash)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Error(t, userStoreService.ValidatePassword(ctx, 1, "password1"))
+			cred := &models.UserCredentials{}
+			userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", 1, CredTypePassword)
+			assert.Equal(t, algorithm, cred.Algorithm)
+			assert.NoError(t, userStoreService.ValidatePassword(ctx, 1, "password"))
+			userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", 1, CredTypePassword)
+			assert.Equal(t, HashArgon2id, cred.Algorithm)
+			assert.NoError(t, userStoreService.ValidatePassword(ctx, 1, "password"))
+		})
+	}
+	t.Run("unsupported", func(t *testing.T) {
+		err := userStoreService.ImportPasswordHash(ctx, 1, "md5", "5f4dcc3b5aa765d61d8327deb882cf99")
+		assert.Error(t, err)
+		err = userStoreService.ImportPasswordHash(ctx, 1, HashSHA256Salted, "nodigest")
+		assert.Error(t, err)
+	})
+	rollbackTransaction(userStoreService.Db)
+}
+
 func TestUserStoreServiceImpl_FindUserByEmail(t *testing.T) {
 	ctx := context.Background()
 	config := &Config{
@@ -134,7 +189,7 @@ func TestUserStoreServiceImpl_FindUserByEmail(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("found", func(t *testing.T) {
 		foundUser, err := userStoreService.FindUserByEmail(ctx, TestUser.EmailAddress)
@@ -156,7 +211,7 @@ func TestUserStoreServiceImpl_FindUserByUsername(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("found", func(t *testing.T) {
 		foundUser, err := userStoreService.FindUserByUsername(ctx, TestUser.Username)
@@ -178,15 +233,24 @@ func TestUserStoreServiceImpl_ValidateTOTP(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("valid", func(t *testing.T) {
 		code, err := totp.GenerateCode(TestUser.Credentials[1].Value, time.Now())
 		if assert.NoError(t, err) {
 			err = userStoreService.ValidateTOTP(ctx, TestUser.ID, code)
 			assert.NoError(t, err)
+			err = userStoreService.ValidateTOTP(ctx, TestUser.ID, code)
+			assert.EqualError(t, err, "totp code already used", "replay")
 		}
 	})
+	t.Run("encrypted on first use", func(t *testing.T) {
+		cred := &models.UserCredentials{}
+		userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", TestUser.ID, CredTypeTOTP)
+		assert.Equal(t, "SHA1", cred.Algorithm)
+		assert.Equal(t, uint(30), cred.Period)
+		assert.NotZero(t, cred.LastTimeStep)
+	})
 	t.Run("invalid", func(t *testing.T) {
 		err := userStoreService.ValidateTOTP(ctx, TestUser.ID, "code")
 		assert.Error(t, err)
@@ -195,9 +259,84 @@ func TestUserStoreServiceImpl_ValidateTOTP(t *testing.T) {
 		err := userStoreService.ValidateTOTP(ctx, 2000, "code")
 		assert.Error(t, err)
 	})
+	t.Run("failure counted once", func(t *testing.T) {
+		id := TestNoCredUser2.ID
+		for _, device := range []string{"phone", "tablet"} {
+			device := device
+			key, _ := totp.Generate(totp.GenerateOpts{Issuer: "cerberus", AccountName: device})
+			cred := &models.UserCredentials{
+				UserID: id, Type: CredTypeTOTP, CredentialID: &device, Name: device,
+				Value: key.Secret(), Algorithm: "SHA1", Period: 30, Digits: 6,
+			}
+			if !assert.NoError(t, userStoreService.Db.Create(cred).Error) {
+				return
+			}
+		}
+		var creds []models.UserCredentials
+		assert.Error(t, userStoreService.ValidateTOTP(ctx, id, "000000"))
+		userStoreService.Db.Order("id").Find(&creds, "user_id = ? and cred_type = ?", id, CredTypeTOTP)
+		if assert.Len(t, creds, 2) {
+			assert.Equal(t, uint(1), creds[0].InvalidAttemptCount)
+			assert.Equal(t, uint(0), creds[1].InvalidAttemptCount)
+		}
+		for i := 0; i < 3; i++ {
+			assert.Error(t, userStoreService.ValidateTOTP(ctx, id, "000000"))
+		}
+		userStoreService.Db.Order("id").Find(&creds, "user_id = ? and cred_type = ?", id, CredTypeTOTP)
+		for _, cred := range creds {
+			assert.True(t, cred.Bocked, cred.Name)
+		}
+		assert.EqualError(t, userStoreService.ValidateTOTP(ctx, id, "000000"), "credential blocked")
+	})
 	rollbackTransaction(userStoreService.Db)
 }
 
+func TestUserStoreServiceImpl_TOTPParameters(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		TOTPPeriod:    60,
+		TOTPDigits:    8,
+		TOTPAlgorithm: "SHA256",
+		TOTPSkew:      2,
+	}
+	enc := &prefixTextEncrypt{}
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, enc, enc, nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	_, secret, err := userStoreService.GenerateTOTP(ctx, TestNoCredUser.ID, "cerberus")
+	if !assert.NoError(t, err) {
+		return
+	}
+	opts := totp.ValidateOpts{Period: 60, Digits: otp.DigitsEight, Algorithm: otp.AlgorithmSHA256}
+	code, err := totp.GenerateCodeCustom(secret, time.Now(), opts)
+	if !assert.NoError(t, err) || !assert.NoError(t, userStoreService.ConfirmTOTP(ctx, TestNoCredUser.ID, "phone", code)) {
+		return
+	}
+	cred := &models.UserCredentials{}
+	userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", TestNoCredUser.ID, CredTypeTOTP)
+	assert.Equal(t, "enc:"+secret, cred.Value)
+	assert.Equal(t, "SHA256", cred.Algorithm)
+	assert.Equal(t, uint8(8), cred.Digits)
+	code, err = totp.GenerateCodeCustom(secret, time.Now().Add(2*time.Minute), opts)
+	if assert.NoError(t, err) {
+		assert.NoError(t, userStoreService.ValidateTOTP(ctx, TestNoCredUser.ID, code), "within skew")
+	}
+	code, err = totp.GenerateCodeCustom(secret, time.Now().Add(-time.Minute), opts)
+	if assert.NoError(t, err) {
+		assert.Error(t, userStoreService.ValidateTOTP(ctx, TestNoCredUser.ID, code), "older than accepted step")
+	}
+	rollbackTransaction(userStoreService.Db)
+}
+
+type prefixTextEncrypt struct{}
+
+func (prefixTextEncrypt) EncryptText(_ context.Context, text string) (string, error) {
+	return "enc:" + text, nil
+}
+
+func (prefixTextEncrypt) DecryptText(_ context.Context, cypherText string) (string, error) {
+	return strings.TrimPrefix(cypherText, "enc:"), nil
+}
+
 func TestUserStoreServiceImpl_SetPassword(t *testing.T) {
 	ctx := context.Background()
 	config := &Config{
@@ -205,7 +344,7 @@ func TestUserStoreServiceImpl_SetPassword(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("success", func(t *testing.T) {
 		err := userStoreService.SetPassword(ctx, TestNoCredUser.ID, "new password")
@@ -215,6 +354,12 @@ func TestUserStoreServiceImpl_SetPassword(t *testing.T) {
 		err := userStoreService.SetPassword(ctx, 2000, "new password")
 		assert.Error(t, err)
 	})
+	t.Run("policy violation", func(t *testing.T) {
+		err := userStoreService.SetPassword(ctx, TestNoCredUser.ID, "")
+		if assert.IsType(t, &PasswordPolicyError{}, err) {
+			assert.Equal(t, ViolationMinLength, err.(*PasswordPolicyError).Violations[0].Rule)
+		}
+	})
 	rollbackTransaction(userStoreService.Db)
 }
 
@@ -224,8 +369,9 @@ func TestUserStoreServiceImpl_GenerateTOTP(t *testing.T) {
 		MaxInvalidLoginAttempt: 3,
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
+		OTPMaxAttempts:         2,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("success", func(t *testing.T) {
 		image, secret, err := userStoreService.GenerateTOTP(ctx, TestNoCredUser.ID, "cerberus")
@@ -234,6 +380,54 @@ func TestUserStoreServiceImpl_GenerateTOTP(t *testing.T) {
 			assert.NotEqual(t, "", secret)
 		}
 	})
+	t.Run("pending until confirmed", func(t *testing.T) {
+		_, secret, err := userStoreService.GenerateTOTP(ctx, TestUser.ID, "cerberus")
+		if !assert.NoError(t, err) {
+			return
+		}
+		status, err := userStoreService.GetTOTPStatus(ctx, TestUser.ID)
+		if assert.NoError(t, err) {
+			assert.True(t, status.Enrolled)
+			assert.True(t, status.Active)
+			assert.True(t, status.Pending)
+		}
+		code, _ := totp.GenerateCode(TestUser.Credentials[1].Value, time.Now())
+		assert.NoError(t, userStoreService.ValidateTOTP(ctx, TestUser.ID, code), "active authenticator kept")
+		assert.Error(t, userStoreService.ConfirmTOTP(ctx, TestUser.ID, "phone", "000000"))
+		code, _ = totp.GenerateCode(secret, time.Now())
+		if !assert.NoError(t, userStoreService.ConfirmTOTP(ctx, TestUser.ID, "phone", code)) {
+			return
+		}
+		assert.EqualError(t, userStoreService.ValidateTOTP(ctx, TestUser.ID, code), "totp code already used")
+		status, err = userStoreService.GetTOTPStatus(ctx, TestUser.ID)
+		if assert.NoError(t, err) {
+			assert.False(t, status.Pending)
+		}
+	})
+	t.Run("expired enrollment", func(t *testing.T) {
+		_, secret, err := userStoreService.GenerateTOTP(ctx, TestNoCredUser.ID, "cerberus")
+		if !assert.NoError(t, err) {
+			return
+		}
+		userStoreService.Db.Model(&models.UserTOTPEnrollment{}).Where("user_id = ?", TestNoCredUser.ID).
+			Update("expires_at", time.Now().Add(-time.Second))
+		code, _ := totp.GenerateCode(secret, time.Now())
+		assert.Error(t, userStoreService.ConfirmTOTP(ctx, TestNoCredUser.ID, "phone", code))
+		status, err := userStoreService.GetTOTPStatus(ctx, TestNoCredUser.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, &TOTPStatus{}, status)
+		}
+	})
+	t.Run("too many attempts", func(t *testing.T) {
+		_, secret, err := userStoreService.GenerateTOTP(ctx, TestNoCredUser.ID, "cerberus")
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.EqualError(t, userStoreService.ConfirmTOTP(ctx, TestNoCredUser.ID, "phone", "000000"), "totp validation failed")
+		assert.EqualError(t, userStoreService.ConfirmTOTP(ctx, TestNoCredUser.ID, "phone", "000000"), "totp validation failed")
+		code, _ := totp.GenerateCode(secret, time.Now())
+		assert.EqualError(t, userStoreService.ConfirmTOTP(ctx, TestNoCredUser.ID, "phone", code), "no pending totp enrollment")
+	})
 	t.Run("user not found", func(t *testing.T) {
 		image, secret, err := userStoreService.GenerateTOTP(ctx, 2000, "cerberus")
 		if assert.Error(t, err) {
@@ -252,7 +446,7 @@ func TestUserStoreServiceImpl_Credential_Block_Unblock(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("blocked", func(t *testing.T) {
 		err := userStoreService.SetPassword(ctx, TestUser.ID, "other password")
@@ -291,7 +485,7 @@ func TestUserStoreServiceImpl_GetUser(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	t.Run("success", func(t *testing.T) {
 		user, err := userStoreService.GetUser(ctx, TestUser.ID)
@@ -311,6 +505,39 @@ func TestUserStoreServiceImpl_GetUser(t *testing.T) {
 	rollbackTransaction(userStoreService.Db)
 }
 
+func TestUserStoreServiceImpl_DeleteUser(t *testing.T) {
+	ctx := context.Background()
+	userStoreService := NewUserStoreServiceImpl(TestDb, &Config{}, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestNoCredUser2.ID
+	expiresAt := time.Now().Add(time.Hour)
+	credentialId := "delete-user"
+	rows := []interface{}{
+		&models.UserCredentials{UserID: id, Type: CredTypeWebAuthn, CredentialID: &credentialId},
+		&models.UserPasswordHistory{UserID: id, Value: "old"},
+		&models.UserResetToken{UserID: id, TokenHash: "delete-user-reset", ExpiresAt: expiresAt},
+		&models.UserOTP{UserID: id, Purpose: OTPPurposeLogin, ExpiresAt: expiresAt},
+		&models.UserTOTPEnrollment{UserID: id, ExpiresAt: expiresAt},
+		&models.UserRecoveryCode{UserID: id, CodeHash: "delete-user-code"},
+		&models.UserEmailVerification{UserID: id, TokenHash: "delete-user-verify", ExpiresAt: expiresAt},
+		&models.UserLoginToken{UserID: id, TokenHash: "delete-user-login", ExpiresAt: expiresAt},
+		&models.UserWebAuthnChallenge{UserID: id, Challenge: "delete-user", ExpiresAt: expiresAt},
+	}
+	for _, row := range rows {
+		if !assert.NoError(t, userStoreService.Db.Create(row).Error) {
+			return
+		}
+	}
+	if assert.NoError(t, userStoreService.DeleteUser(ctx, id)) {
+		for _, table := range userOwnedTables {
+			var count int64
+			userStoreService.Db.Model(table).Where("user_id = ?", id).Count(&count)
+			assert.Equal(t, int64(0), count, "%T left over", table)
+		}
+	}
+	rollbackTransaction(userStoreService.Db)
+}
+
 func TestUserStoreServiceImpl_GetClaims(t *testing.T) {
 	ctx := context.Background()
 	config := &Config{
@@ -318,8 +545,325 @@ func TestUserStoreServiceImpl_GetClaims(t *testing.T) {
 		InvalidAttemptWindow:   5 * time.Minute,
 		TOTPSecretLength:       6,
 	}
-	userStoreService := NewUserStoreServiceImpl(TestDb, config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
 	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
 	_, _ = userStoreService.GetClaims(ctx, "us", []string{"openid"}, []string{})
 	rollbackTransaction(userStoreService.Db)
 }
+
+func TestUserStoreServiceImpl_PasswordHistory(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		PasswordHistorySize: 2,
+		Argon2Memory:        1024,
+		Argon2Iterations:    1,
+	}
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestNoCredUser2.ID
+	for _, password := range []string{"first password", "second password"} {
+		if !assert.NoError(t, userStoreService.SetPassword(ctx, id, password)) {
+			return
+		}
+	}
+	t.Run("reused", func(t *testing.T) {
+		err := userStoreService.SetPassword(ctx, id, "first password")
+		if assert.IsType(t, &PasswordPolicyError{}, err) {
+			assert.Equal(t, PasswordViolation{Rule: ViolationReused, Limit: 2}, err.(*PasswordPolicyError).Violations[0])
+		}
+	})
+	t.Run("pruned", func(t *testing.T) {
+		assert.NoError(t, userStoreService.SetPassword(ctx, id, "third password"))
+		var count int64
+		userStoreService.Db.Model(&models.UserPasswordHistory{}).Where("user_id = ?", id).Count(&count)
+		assert.Equal(t, int64(2), count)
+		assert.NoError(t, userStoreService.SetPassword(ctx, id, "first password"))
+	})
+	t.Run("deleted with user", func(t *testing.T) {
+		assert.NoError(t, userStoreService.DeleteUser(ctx, id))
+		var count int64
+		userStoreService.Db.Model(&models.UserPasswordHistory{}).Where("user_id = ?", id).Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+	rollbackTransaction(userStoreService.Db)
+}
+
+func TestUserStoreServiceImpl_PasswordChangeRequired(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		PasswordMaxAge:   time.Hour,
+		Argon2Memory:     1024,
+		Argon2Iterations: 1,
+	}
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestNoCredUser2.ID
+	if !assert.NoError(t, userStoreService.SetPassword(ctx, id, "password")) {
+		return
+	}
+	t.Run("fresh", func(t *testing.T) {
+		assert.NoError(t, userStoreService.ValidatePassword(ctx, id, "password"))
+	})
+	t.Run("expired", func(t *testing.T) {
+		userStoreService.Db.Model(&models.UserCredentials{}).Where("user_id = ?", id).
+			Update("changed_at", time.Now().Add(-2*time.Hour))
+		err := userStoreService.ValidatePassword(ctx, id, "password")
+		assert.Equal(t, &PasswordChangeRequiredError{Reason: PasswordChangeExpired}, err)
+		assert.EqualError(t, userStoreService.ValidatePassword(ctx, id, "wrong"), "password mismatch")
+	})
+	t.Run("requested", func(t *testing.T) {
+		assert.NoError(t, userStoreService.SetPassword(ctx, id, "new password"))
+		assert.NoError(t, userStoreService.RequirePasswordChange(ctx, id))
+		err := userStoreService.ValidatePassword(ctx, id, "new password")
+		assert.Equal(t, &PasswordChangeRequiredError{Reason: PasswordChangeRequested}, err)
+		assert.NoError(t, userStoreService.SetPassword(ctx, id, "newer password"))
+		assert.NoError(t, userStoreService.ValidatePassword(ctx, id, "newer password"))
+	})
+	t.Run("no password", func(t *testing.T) {
+		assert.Error(t, userStoreService.RequirePasswordChange(ctx, 2000))
+	})
+	rollbackTransaction(userStoreService.Db)
+}
+
+func TestUserStoreServiceImpl_ValidateOTP(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		EncryptionKey:  "otp-key",
+		OTPTTL:         time.Minute,
+		OTPMaxAttempts: 2,
+	}
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestUser.ID
+	t.Run("no code", func(t *testing.T) {
+		assert.Equal(t, ErrInvalidOTP, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, "123456"))
+	})
+	t.Run("single use", func(t *testing.T) {
+		code, err := userStoreService.GenerateUserOTP(ctx, id, OTPPurposeLogin, 6)
+		if !assert.NoError(t, err) {
+			return
+		}
+		otp := &models.UserOTP{}
+		userStoreService.Db.Find(otp, "user_id = ?", id)
+		assert.NotEqual(t, code, otp.ValueHash)
+		assert.Equal(t, ErrInvalidOTP, userStoreService.ValidateOTP(ctx, id, OTPPurposeReset, code), "purpose bound")
+		assert.NoError(t, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, code))
+		assert.Equal(t, ErrInvalidOTP, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, code))
+	})
+	t.Run("max attempts", func(t *testing.T) {
+		code, err := userStoreService.GenerateUserOTP(ctx, id, OTPPurposeLogin, 6)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Error(t, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, "wrong"))
+		assert.Error(t, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, "wrong"))
+		assert.Equal(t, ErrInvalidOTP, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, code))
+	})
+	t.Run("expired", func(t *testing.T) {
+		code, err := userStoreService.GenerateUserOTP(ctx, id, OTPPurposeLogin, 6)
+		if !assert.NoError(t, err) {
+			return
+		}
+		userStoreService.Db.Model(&models.UserOTP{}).Where("user_id = ?", id).
+			Update("expires_at", time.Now().Add(-time.Second))
+		assert.Equal(t, ErrInvalidOTP, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, code))
+	})
+	t.Run("attempts used elsewhere", func(t *testing.T) {
+		code, err := userStoreService.GenerateUserOTP(ctx, id, OTPPurposeLogin, 6)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, ErrInvalidOTP, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, "wrong"))
+		// a concurrent guess used the last attempt after this request loaded the code
+		userStoreService.Db.Model(&models.UserOTP{}).Where("user_id = ?", id).Update("attempts", 2)
+		assert.Equal(t, ErrInvalidOTP, userStoreService.ValidateOTP(ctx, id, OTPPurposeLogin, code))
+	})
+	t.Run("invalid purpose", func(t *testing.T) {
+		_, err := userStoreService.GenerateUserOTP(ctx, id, "other", 6)
+		assert.Error(t, err)
+	})
+	t.Run("no encryption key", func(t *testing.T) {
+		noKey := NewUserStoreServiceImpl(userStoreService.Db, &Config{}, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+		_, err := noKey.GenerateUserOTP(ctx, id, OTPPurposeLogin, 6)
+		assert.Equal(t, ErrOTPKeyMissing, err)
+	})
+	rollbackTransaction(userStoreService.Db)
+}
+
+func TestUserStoreServiceImpl_RecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		EncryptionKey:          "recovery-key",
+		MaxInvalidLoginAttempt: 2,
+		InvalidAttemptWindow:   5 * time.Minute,
+		RecoveryCodeCount:      4,
+	}
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestUser.ID
+	t.Run("not generated", func(t *testing.T) {
+		assert.Error(t, userStoreService.ValidateRecoveryCode(ctx, id, "AAAAA-AAAAA"))
+	})
+	codes, err := userStoreService.GenerateRecoveryCodes(ctx, id)
+	if !assert.NoError(t, err) || !assert.Equal(t, 4, len(codes)) {
+		return
+	}
+	t.Run("consume", func(t *testing.T) {
+		assert.NoError(t, userStoreService.ValidateRecoveryCode(ctx, id, strings.ToLower(codes[0])))
+		assert.Error(t, userStoreService.ValidateRecoveryCode(ctx, id, codes[0]), "single use")
+		remaining, err := userStoreService.GetRemainingRecoveryCodes(ctx, id)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 3, remaining)
+		}
+	})
+	t.Run("regenerate", func(t *testing.T) {
+		fresh, err := userStoreService.GenerateRecoveryCodes(ctx, id)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Error(t, userStoreService.ValidateRecoveryCode(ctx, id, codes[1]), "old set revoked")
+		assert.NoError(t, userStoreService.ValidateRecoveryCode(ctx, id, fresh[1]))
+		codes = fresh
+	})
+	t.Run("valid code clears failures", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			assert.Error(t, userStoreService.ValidateRecoveryCode(ctx, id, "AAAAA-AAAAA"))
+		}
+		assert.NoError(t, userStoreService.ValidateRecoveryCode(ctx, id, codes[3]))
+		cred := &models.UserCredentials{}
+		userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", id, CredTypeRecoveryCodes)
+		assert.Equal(t, uint(0), cred.InvalidAttemptCount)
+		assert.Nil(t, cred.FirstInvalidAttempt)
+	})
+	t.Run("failures out of the window", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			assert.Error(t, userStoreService.ValidateRecoveryCode(ctx, id, "AAAAA-AAAAA"))
+		}
+		userStoreService.Db.Model(&models.UserCredentials{}).Where("user_id = ? and cred_type = ?", id, CredTypeRecoveryCodes).
+			Update("first_invalid_attempt", time.Now().Add(-10*time.Minute))
+		assert.Error(t, userStoreService.ValidateRecoveryCode(ctx, id, "AAAAA-AAAAA"))
+		cred := &models.UserCredentials{}
+		userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", id, CredTypeRecoveryCodes)
+		assert.Equal(t, uint(1), cred.InvalidAttemptCount)
+		assert.False(t, cred.Bocked)
+		userStoreService.Db.Model(cred).Updates(map[string]interface{}{"invalid_attempt_count": 0, "first_invalid_attempt": nil})
+	})
+	t.Run("lockout", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.Error(t, userStoreService.ValidateRecoveryCode(ctx, id, "AAAAA-AAAAA"))
+			cred := &models.UserCredentials{}
+			userStoreService.Db.Find(cred, "user_id = ? and cred_type = ?", id, CredTypeRecoveryCodes)
+			assert.Equal(t, uint(i+1), cred.InvalidAttemptCount)
+		}
+		assert.EqualError(t, userStoreService.ValidateRecoveryCode(ctx, id, codes[2]), "credential blocked")
+	})
+	t.Run("no encryption key", func(t *testing.T) {
+		noKey := NewUserStoreServiceImpl(userStoreService.Db, &Config{}, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+		_, err := noKey.GenerateRecoveryCodes(ctx, TestNoCredUser.ID)
+		assert.Equal(t, ErrRecoveryKeyMissing, err)
+		assert.Equal(t, ErrRecoveryKeyMissing, noKey.ValidateRecoveryCode(ctx, id, codes[2]))
+	})
+	rollbackTransaction(userStoreService.Db)
+}
+
+func TestUserStoreServiceImpl_Credentials(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		MaxInvalidLoginAttempt: 3,
+		InvalidAttemptWindow:   5 * time.Minute,
+	}
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), nil)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestNoCredUser2.ID
+	var secrets []string
+	for _, name := range []string{"phone", "tablet"} {
+		_, secret, err := userStoreService.GenerateTOTP(ctx, id, "cerberus")
+		if !assert.NoError(t, err) {
+			return
+		}
+		code, _ := totp.GenerateCode(secret, time.Now())
+		if !assert.NoError(t, userStoreService.ConfirmTOTP(ctx, id, name, code)) {
+			return
+		}
+		secrets = append(secrets, secret)
+	}
+	if !assert.NoError(t, userStoreService.SetPassword(ctx, id, "new password")) {
+		return
+	}
+	t.Run("list", func(t *testing.T) {
+		creds, err := userStoreService.ListCredentials(ctx, id)
+		if assert.NoError(t, err) && assert.Len(t, creds, 3) {
+			assert.Equal(t, uint8(CredTypePassword), creds[0].Type)
+			assert.Equal(t, "phone", creds[1].Name)
+			assert.Equal(t, "tablet", creds[2].Name)
+			assert.Equal(t, "", creds[2].Value)
+		}
+	})
+	t.Run("each device validates", func(t *testing.T) {
+		code, _ := totp.GenerateCode(secrets[1], time.Now().Add(30*time.Second))
+		assert.NoError(t, userStoreService.ValidateTOTP(ctx, id, code))
+	})
+	t.Run("rename and remove", func(t *testing.T) {
+		creds, err := userStoreService.ListCredentials(ctx, id)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, userStoreService.RenameCredential(ctx, id, creds[1].ID, "old phone"))
+		assert.Error(t, userStoreService.RenameCredential(ctx, TestUser.ID, creds[1].ID, "stolen"))
+		assert.EqualError(t, userStoreService.RemoveCredential(ctx, id, creds[0].ID), "password credential can not be removed")
+		assert.NoError(t, userStoreService.RemoveCredential(ctx, id, creds[2].ID))
+		creds, err = userStoreService.ListCredentials(ctx, id)
+		if assert.NoError(t, err) && assert.Len(t, creds, 2) {
+			assert.Equal(t, "old phone", creds[1].Name)
+		}
+	})
+	rollbackTransaction(userStoreService.Db)
+}
+
+func TestUserStoreServiceImpl_EmailChange(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{EncryptionKey: "otp-key"}
+	notifier, output := newBufferNotifier(config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), notifier)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestNoCredUser.ID
+	if !assert.NoError(t, userStoreService.InitiateEmailChange(ctx, id, "changed@domain.com")) {
+		return
+	}
+	assert.Contains(t, output.String(), "To: changed@domain.com\nSubject: Confirm your new email address")
+	code := regexp.MustCompile(`code is (\d{6})`).FindStringSubmatch(output.String())[1]
+	if assert.NoError(t, userStoreService.CompleteEmailChange(ctx, id, code)) {
+		user, _ := userStoreService.GetUser(ctx, id)
+		assert.Equal(t, "changed@domain.com", user.EmailAddress)
+		assert.Equal(t, "", user.TempEmailAddress)
+	}
+	rollbackTransaction(userStoreService.Db)
+}
+
+func TestUserStoreServiceImpl_PhoneVerification(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{EncryptionKey: "otp-key"}
+	notifier, output := newBufferNotifier(config)
+	userStoreService := NewUserStoreServiceImpl(TestDb, config, NewNoOpTextEncrypt(), NewNoOpTextEncrypt(), notifier)
+	userStoreService.Db = beginTransaction(ctx, userStoreService.Db)
+	id := TestNoCredUser.ID
+	assert.Error(t, userStoreService.InitiatePhoneVerification(ctx, id, "555-0100"))
+	if !assert.NoError(t, userStoreService.InitiatePhoneVerification(ctx, id, "+15550100")) {
+		return
+	}
+	assert.Contains(t, output.String(), "SMS To: +15550100")
+	user, _ := userStoreService.GetUser(ctx, id)
+	assert.Equal(t, "", user.Metadata.GetPhoneNumber(), "pending until confirmed")
+	assert.Equal(t, ErrInvalidOTP, userStoreService.CompletePhoneVerification(ctx, id, "000000x"))
+	code := regexp.MustCompile(`code is (\d{6})`).FindStringSubmatch(output.String())[1]
+	userStoreService.Db.Model(&models.UserModel{}).Where("id = ?", id).Update("temp_phone_number", "")
+	assert.EqualError(t, userStoreService.CompletePhoneVerification(ctx, id, code), "no phone number pending verification")
+	userStoreService.Db.Model(&models.UserModel{}).Where("id = ?", id).Update("temp_phone_number", "+15550100")
+	if assert.NoError(t, userStoreService.CompletePhoneVerification(ctx, id, code)) {
+		user, _ = userStoreService.GetUser(ctx, id)
+		assert.Equal(t, "+15550100", user.Metadata.GetPhoneNumber())
+		assert.True(t, user.Metadata.GetPhoneNumberVerified())
+		assert.Equal(t, "", user.TempPhoneNumber)
+	}
+	rollbackTransaction(userStoreService.Db)
+}
@@ -0,0 +1,353 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+	"image"
+	"time"
+)
+
+const (
+	defaultTOTPEnrollmentTTL = 10 * time.Minute
+	defaultTOTPPeriod        = 30
+	defaultTOTPDigits        = 6
+	defaultTOTPAlgorithm     = "SHA1"
+	defaultTOTPSkew          = 1
+)
+
+// TOTPStatus tells whether the user has confirmed authenticators, whether one of them can be used,
+// and whether an enrollment is waiting for confirmation.
+type TOTPStatus struct {
+	Enrolled         bool       `json:"enrolled"`
+	Active           bool       `json:"active"`
+	Pending          bool       `json:"pending"`
+	PendingExpiresAt *time.Time `json:"pending_expires_at,omitempty"`
+}
+
+// totpParameters are the parameters an authenticator was enrolled with.
+type totpParameters struct {
+	Algorithm string
+	Period    uint
+	Digits    uint8
+}
+
+func (u *UserStoreServiceImpl) configuredTOTPParameters() totpParameters {
+	parameters := totpParameters{Algorithm: u.Config.TOTPAlgorithm, Period: u.Config.TOTPPeriod, Digits: u.Config.TOTPDigits}
+	if parameters.Algorithm == "" {
+		parameters.Algorithm = defaultTOTPAlgorithm
+	}
+	if parameters.Period == 0 {
+		parameters.Period = defaultTOTPPeriod
+	}
+	if parameters.Digits == 0 {
+		parameters.Digits = defaultTOTPDigits
+	}
+	return parameters
+}
+
+// GenerateTOTP starts the enrollment of an authenticator. The new secret stays pending until
+// ConfirmTOTP proves the authenticator works. A new enrollment replaces the pending one, which
+// expires after Config.TOTPEnrollmentTTL.
+func (u *UserStoreServiceImpl) GenerateTOTP(ctx context.Context, id uint, issuer string) (image.Image, string, error) {
+	user := &models.UserModel{}
+	user.ID = id
+	db := u.Db.WithContext(ctx)
+	result := db.Find(user)
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, "", fmt.Errorf("user not found with id %d", id)
+	}
+	parameters := u.configuredTOTPParameters()
+	algorithm, err := totpAlgorithm(parameters.Algorithm)
+	if err != nil {
+		return nil, "", err
+	}
+	opt := totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: user.Username,
+		SecretSize:  u.Config.TOTPSecretLength,
+		Period:      parameters.Period,
+		Digits:      otp.Digits(parameters.Digits),
+		Algorithm:   algorithm,
+	}
+	key, err := totp.Generate(opt)
+	if err != nil {
+		return nil, "", err
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := u.TextEnc.EncryptText(ctx, key.Secret())
+	if err != nil {
+		return nil, "", err
+	}
+	ttl := u.Config.TOTPEnrollmentTTL
+	if ttl <= 0 {
+		ttl = defaultTOTPEnrollmentTTL
+	}
+	err = db.Delete(&models.UserTOTPEnrollment{}, "user_id = ?", id).Error
+	if err != nil {
+		return nil, "", err
+	}
+	enrollment := &models.UserTOTPEnrollment{
+		UserID:    id,
+		Secret:    secret,
+		Algorithm: parameters.Algorithm,
+		Period:    parameters.Period,
+		Digits:    parameters.Digits,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	err = db.Create(enrollment).Error
+	if err != nil {
+		return nil, "", err
+	}
+	return img, key.Secret(), nil
+}
+
+// ConfirmTOTP adds the pending enrollment as a TOTP credential with the friendly name once the code
+// of the authenticator validates against it. The code can not be used again to log in. The enrollment
+// is dropped after Config.OTPMaxAttempts wrong codes, the user has to start over with GenerateTOTP.
+func (u *UserStoreServiceImpl) ConfirmTOTP(ctx context.Context, id uint, name string, code string) error {
+	db := u.Db.WithContext(ctx)
+	enrollment := &models.UserTOTPEnrollment{}
+	maxAttempts := u.otpMaxAttempts()
+	result := db.Find(enrollment, "user_id = ? and expires_at > ? and attempts < ?", id, time.Now(), maxAttempts)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return errors.New("no pending totp enrollment")
+	}
+	secret, err := u.TextDec.DecryptText(ctx, enrollment.Secret)
+	if err != nil {
+		return err
+	}
+	parameters := totpParameters{Algorithm: enrollment.Algorithm, Period: enrollment.Period, Digits: enrollment.Digits}
+	step, err := u.matchTOTP(secret, code, parameters)
+	if err != nil {
+		return err
+	}
+	if step == 0 {
+		updateResult := db.Model(enrollment).Where("attempts < ?", maxAttempts).
+			UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+		if updateResult.Error != nil {
+			return updateResult.Error
+		}
+		if updateResult.RowsAffected == 1 && enrollment.Attempts+1 >= maxAttempts {
+			if err = db.Delete(enrollment).Error; err != nil {
+				return err
+			}
+		}
+		return errors.New("totp validation failed")
+	}
+	random, err := GenerateRandomBytes(16)
+	if err != nil {
+		return err
+	}
+	credentialId := hex.EncodeToString(random)
+	now := time.Now()
+	cred := &models.UserCredentials{
+		UserID:       id,
+		Type:         CredTypeTOTP,
+		CredentialID: &credentialId,
+		Name:         name,
+		Value:        enrollment.Secret,
+		Algorithm:    enrollment.Algorithm,
+		Period:       enrollment.Period,
+		Digits:       enrollment.Digits,
+		LastTimeStep: step,
+		ChangedAt:    &now,
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(cred).Error; err != nil {
+			return err
+		}
+		deleteResult := tx.Where("attempts < ?", maxAttempts).Delete(enrollment)
+		if deleteResult.Error != nil {
+			return deleteResult.Error
+		}
+		if deleteResult.RowsAffected != 1 {
+			// confirmed concurrently, or out of attempts meanwhile
+			return errors.New("no pending totp enrollment")
+		}
+		return nil
+	})
+}
+
+// ValidateTOTP checks the code against the authenticators of the user. A code is accepted once: the
+// time step of the last accepted code is recorded and codes of that or an earlier step are rejected.
+// A wrong code counts once per user, as an invalid attempt on the first active authenticator of the
+// user; once that one is blocked, every authenticator of the user is. Credentials stored before the
+// secrets were encrypted are encrypted on first use.
+func (u *UserStoreServiceImpl) ValidateTOTP(ctx context.Context, id uint, code string) error {
+	user := &models.UserModel{}
+	user.ID = id
+	db := u.Db.WithContext(ctx)
+	findResult := db.Find(user)
+	if findResult.Error != nil {
+		return findResult.Error
+	}
+	if findResult.RowsAffected != 1 {
+		return fmt.Errorf("user not found with id %d", id)
+	}
+	if user.Inactive {
+		return errors.New("user inactive")
+	}
+	var creds []models.UserCredentials
+	err := db.Order("id").Find(&creds, "user_id = ? and cred_type = ?", id, CredTypeTOTP).Error
+	if err != nil {
+		return err
+	}
+	if len(creds) == 0 {
+		return fmt.Errorf("totp not enrolled for user %d", id)
+	}
+	var active []*models.UserCredentials
+	for i := range creds {
+		if !creds[i].Bocked {
+			active = append(active, &creds[i])
+		}
+	}
+	if len(active) == 0 {
+		return errors.New("credential blocked")
+	}
+	replayed := false
+	for _, cred := range active {
+		legacy := cred.Algorithm == ""
+		secret := cred.Value
+		parameters := totpParameters{Algorithm: cred.Algorithm, Period: cred.Period, Digits: cred.Digits}
+		if legacy {
+			parameters = totpParameters{Algorithm: defaultTOTPAlgorithm, Period: defaultTOTPPeriod, Digits: defaultTOTPDigits}
+		} else {
+			secret, err = u.TextDec.DecryptText(ctx, cred.Value)
+			if err != nil {
+				return err
+			}
+		}
+		step, err := u.matchTOTP(secret, code, parameters)
+		if err != nil {
+			return err
+		}
+		if step == 0 {
+			continue
+		}
+		if step <= cred.LastTimeStep {
+			replayed = true
+			continue
+		}
+		updates := map[string]interface{}{"last_time_step": step}
+		if legacy {
+			encrypted, err := u.TextEnc.EncryptText(ctx, secret)
+			if err != nil {
+				return err
+			}
+			updates["value"] = encrypted
+			updates["algorithm"] = parameters.Algorithm
+			updates["period"] = parameters.Period
+			updates["digits"] = parameters.Digits
+		}
+		// the step condition makes concurrent validations of the same code accept only one of them
+		updateResult := db.Model(cred).Where("last_time_step < ?", step).Updates(updates)
+		if updateResult.Error != nil {
+			return updateResult.Error
+		}
+		if updateResult.RowsAffected != 1 {
+			return errors.New("totp code already used")
+		}
+		return nil
+	}
+	counted := active[0]
+	blocked := counted.IncrementInvalidAttempt(u.Config.MaxInvalidLoginAttempt, u.Config.InvalidAttemptWindow)
+	if err = db.Save(counted).Error; err != nil {
+		return err
+	}
+	if blocked {
+		err = db.Model(&models.UserCredentials{}).Where("user_id = ? and cred_type = ?", id, CredTypeTOTP).
+			Update("blocked", true).Error
+		if err != nil {
+			return err
+		}
+	}
+	if replayed {
+		return errors.New("totp code already used")
+	}
+	return errors.New("totp validation failed")
+}
+
+// matchTOTP returns the time step the code was generated for, looking Config.TOTPSkew steps around
+// the current one, or zero when the code does not match.
+func (u *UserStoreServiceImpl) matchTOTP(secret string, code string, parameters totpParameters) (uint64, error) {
+	algorithm, err := totpAlgorithm(parameters.Algorithm)
+	if err != nil {
+		return 0, err
+	}
+	skew := u.Config.TOTPSkew
+	if skew == 0 {
+		skew = defaultTOTPSkew
+	}
+	opts := totp.ValidateOpts{Period: parameters.Period, Digits: otp.Digits(parameters.Digits), Algorithm: algorithm}
+	current := time.Now().Unix() / int64(parameters.Period)
+	for step := current - int64(skew); step <= current+int64(skew); step++ {
+		if step <= 0 {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*int64(parameters.Period), 0).UTC(), opts)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return uint64(step), nil
+		}
+	}
+	return 0, nil
+}
+
+func totpAlgorithm(name string) (otp.Algorithm, error) {
+	switch name {
+	case "SHA1":
+		return otp.AlgorithmSHA1, nil
+	case "SHA256":
+		return otp.AlgorithmSHA256, nil
+	case "SHA512":
+		return otp.AlgorithmSHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported totp algorithm %s", name)
+	}
+}
+
+func (u *UserStoreServiceImpl) GetTOTPStatus(ctx context.Context, id uint) (*TOTPStatus, error) {
+	user, err := u.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	db := u.Db.WithContext(ctx)
+	status := &TOTPStatus{}
+	var creds []models.UserCredentials
+	err = db.Find(&creds, "user_id = ? and cred_type = ?", id, CredTypeTOTP).Error
+	if err != nil {
+		return nil, err
+	}
+	status.Enrolled = len(creds) > 0
+	for _, cred := range creds {
+		status.Active = status.Active || !cred.Bocked && !user.Inactive
+	}
+	enrollment := &models.UserTOTPEnrollment{}
+	result := db.Find(enrollment, "user_id = ? and expires_at > ?", id, time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 1 {
+		status.Pending = true
+		status.PendingExpiresAt = &enrollment.ExpiresAt
+	}
+	return status, nil
+}
@@ -0,0 +1,555 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/identityOrg/cerberus-core/models"
+	"gorm.io/gorm"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webAuthnCeremonyCreate  = "webauthn.create"
+	webAuthnCeremonyGet     = "webauthn.get"
+	webAuthnChallengeLength = 32
+	defaultWebAuthnTimeout  = 5 * time.Minute
+)
+
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+const (
+	authenticatorFlagUserPresent  = 0x01
+	authenticatorFlagUserVerified = 0x04
+	authenticatorFlagAttested     = 0x40
+)
+
+var (
+	ErrWebAuthnSignCount            = errors.New("webauthn sign count did not increase, the authenticator may be cloned")
+	ErrWebAuthnCredentialRegistered = errors.New("webauthn credential already registered")
+)
+
+var b64url = base64.RawURLEncoding
+
+type (
+	WebAuthnRelyingParty struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	WebAuthnUserEntity struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	WebAuthnCredentialParameter struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+	WebAuthnCredentialDescriptor struct {
+		Type       string   `json:"type"`
+		ID         string   `json:"id"`
+		Transports []string `json:"transports,omitempty"`
+	}
+	WebAuthnAuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+	// WebAuthnCreationOptions are the PublicKeyCredentialCreationOptions of a registration, binary
+	// values are base64url encoded.
+	WebAuthnCreationOptions struct {
+		Challenge              string                         `json:"challenge"`
+		RP                     WebAuthnRelyingParty           `json:"rp"`
+		User                   WebAuthnUserEntity             `json:"user"`
+		PubKeyCredParams       []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+		Timeout                int64                          `json:"timeout"`
+		ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials,omitempty"`
+		AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+		Attestation            string                         `json:"attestation"`
+	}
+	// WebAuthnRequestOptions are the PublicKeyCredentialRequestOptions of a login.
+	WebAuthnRequestOptions struct {
+		Challenge        string                         `json:"challenge"`
+		Timeout          int64                          `json:"timeout"`
+		RPID             string                         `json:"rpId"`
+		AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials,omitempty"`
+		UserVerification string                         `json:"userVerification"`
+	}
+	WebAuthnAttestationResponse struct {
+		ClientDataJSON    []byte   `json:"clientDataJSON"`
+		AttestationObject []byte   `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	}
+	WebAuthnAssertionResponse struct {
+		CredentialID      string `json:"id"`
+		ClientDataJSON    []byte `json:"clientDataJSON"`
+		AuthenticatorData []byte `json:"authenticatorData"`
+		Signature         []byte `json:"signature"`
+		UserHandle        []byte `json:"userHandle,omitempty"`
+	}
+)
+
+// WebAuthnServiceImpl runs the WebAuthn registration and login ceremonies and stores the resulting
+// credentials as CredTypeWebAuthn user credentials. Challenges are stored server side, expire after
+// Config.WebAuthnTimeout and are consumed by the first response that uses them.
+type WebAuthnServiceImpl struct {
+	Db     *gorm.DB
+	Config *Config
+}
+
+func NewWebAuthnServiceImpl(db *gorm.DB, config *Config) *WebAuthnServiceImpl {
+	return &WebAuthnServiceImpl{Db: db, Config: config}
+}
+
+func (w *WebAuthnServiceImpl) BeginWebAuthnRegistration(ctx context.Context, id uint) (*WebAuthnCreationOptions, error) {
+	db := w.Db.WithContext(ctx)
+	user := &models.UserModel{}
+	user.ID = id
+	result := db.Find(user)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, fmt.Errorf("user not found with id %d", id)
+	}
+	existing, err := w.credentialDescriptors(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := w.newChallenge(ctx, id, webAuthnCeremonyCreate)
+	if err != nil {
+		return nil, err
+	}
+	name := w.Config.WebAuthnRPName
+	if name == "" {
+		name = w.Config.WebAuthnRPID
+	}
+	return &WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        WebAuthnRelyingParty{ID: w.Config.WebAuthnRPID, Name: name},
+		User: WebAuthnUserEntity{
+			ID:          b64url.EncodeToString(webAuthnUserHandle(id)),
+			Name:        user.Username,
+			DisplayName: user.Username,
+		},
+		PubKeyCredParams: []WebAuthnCredentialParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            w.timeout().Milliseconds(),
+		ExcludeCredentials: existing,
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: w.userVerification(),
+		},
+		Attestation: "none",
+	}, nil
+}
+
+// FinishWebAuthnRegistration verifies the response of the authenticator and stores the new
+// credential under the friendly name. The registration asks for no attestation, so an attestation
+// statement is not verified. It returns the base64url credential id.
+func (w *WebAuthnServiceImpl) FinishWebAuthnRegistration(ctx context.Context, id uint, name string, response *WebAuthnAttestationResponse) (string, error) {
+	challenge, err := w.verifyClientData(ctx, response.ClientDataJSON, webAuthnCeremonyCreate)
+	if err != nil {
+		return "", err
+	}
+	if challenge.UserID != id {
+		return "", errors.New("webauthn challenge was issued to another user")
+	}
+	attestation := struct {
+		Format   string          `cbor:"fmt"`
+		AttStmt  cbor.RawMessage `cbor:"attStmt"`
+		AuthData []byte          `cbor:"authData"`
+	}{}
+	if err = cbor.Unmarshal(response.AttestationObject, &attestation); err != nil {
+		return "", fmt.Errorf("invalid attestation object: %w", err)
+	}
+	authData, err := w.verifyAuthenticatorData(attestation.AuthData)
+	if err != nil {
+		return "", err
+	}
+	if authData.Flags&authenticatorFlagAttested == 0 {
+		return "", errors.New("attested credential data missing")
+	}
+	if _, _, err = parseCOSEKey(authData.PublicKey); err != nil {
+		return "", err
+	}
+	credentialId := b64url.EncodeToString(authData.CredentialID)
+	db := w.Db.WithContext(ctx)
+	registered := func() (bool, error) {
+		var count int64
+		err := db.Model(&models.UserCredentials{}).Where("credential_id = ? and cred_type = ?", credentialId, CredTypeWebAuthn).
+			Count(&count).Error
+		return count > 0, err
+	}
+	exists, err := registered()
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", ErrWebAuthnCredentialRegistered
+	}
+	now := time.Now()
+	cred := &models.UserCredentials{
+		UserID:       id,
+		Type:         CredTypeWebAuthn,
+		CredentialID: &credentialId,
+		Name:         name,
+		PublicKey:    authData.PublicKey,
+		SignCount:    authData.SignCount,
+		AAGUID:       authData.AAGUID,
+		Transports:   strings.Join(response.Transports, ","),
+		ChangedAt:    &now,
+	}
+	if err = db.Create(cred).Error; err != nil {
+		// the unique index rejects a concurrent registration of the same credential
+		if exists, _ := registered(); exists {
+			return "", ErrWebAuthnCredentialRegistered
+		}
+		return "", err
+	}
+	return credentialId, nil
+}
+
+// BeginWebAuthnLogin starts a login of the user with the username, or a login with a discoverable
+// credential when the username is empty.
+func (w *WebAuthnServiceImpl) BeginWebAuthnLogin(ctx context.Context, username string) (*WebAuthnRequestOptions, error) {
+	var id uint
+	var allowed []WebAuthnCredentialDescriptor
+	if username != "" {
+		user := &models.UserModel{}
+		result := w.Db.WithContext(ctx).Find(user, "username = ?", username)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected != 1 {
+			return nil, fmt.Errorf("user not found with username %s", username)
+		}
+		var err error
+		if allowed, err = w.credentialDescriptors(ctx, user.ID); err != nil {
+			return nil, err
+		}
+		if len(allowed) == 0 {
+			return nil, fmt.Errorf("no webauthn credential registered for %s", username)
+		}
+		id = user.ID
+	}
+	challenge, err := w.newChallenge(ctx, id, webAuthnCeremonyGet)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          w.timeout().Milliseconds(),
+		RPID:             w.Config.WebAuthnRPID,
+		AllowCredentials: allowed,
+		UserVerification: w.userVerification(),
+	}, nil
+}
+
+// FinishWebAuthnLogin verifies the assertion and returns the id of the user it authenticates. A sign
+// count that does not increase blocks the credential and fails with ErrWebAuthnSignCount.
+func (w *WebAuthnServiceImpl) FinishWebAuthnLogin(ctx context.Context, response *WebAuthnAssertionResponse) (uint, error) {
+	challenge, err := w.verifyClientData(ctx, response.ClientDataJSON, webAuthnCeremonyGet)
+	if err != nil {
+		return 0, err
+	}
+	rawId, err := b64url.DecodeString(strings.TrimRight(response.CredentialID, "="))
+	if err != nil {
+		return 0, errors.New("invalid webauthn credential id")
+	}
+	db := w.Db.WithContext(ctx)
+	cred := &models.UserCredentials{}
+	result := db.Find(cred, "credential_id = ? and cred_type = ?", b64url.EncodeToString(rawId), CredTypeWebAuthn)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return 0, errors.New("unknown webauthn credential")
+	}
+	if challenge.UserID != 0 && challenge.UserID != cred.UserID {
+		return 0, errors.New("webauthn challenge was issued to another user")
+	}
+	if len(response.UserHandle) > 0 && !bytes.Equal(response.UserHandle, webAuthnUserHandle(cred.UserID)) {
+		return 0, errors.New("webauthn user handle does not match the credential")
+	}
+	user := &models.UserModel{}
+	user.ID = cred.UserID
+	result = db.Find(user)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return 0, fmt.Errorf("user not found with id %d", cred.UserID)
+	}
+	if user.Inactive {
+		return 0, errors.New("user inactive")
+	}
+	if cred.Bocked {
+		return 0, errors.New("credential blocked")
+	}
+	authData, err := w.verifyAuthenticatorData(response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	publicKey, algorithm, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(response.ClientDataJSON)
+	signed := append(append([]byte{}, response.AuthenticatorData...), clientDataHash[:]...)
+	if err = verifyWebAuthnSignature(publicKey, algorithm, signed, response.Signature); err != nil {
+		cred.IncrementInvalidAttempt(w.Config.MaxInvalidLoginAttempt, w.Config.InvalidAttemptWindow)
+		db.Save(cred)
+		return 0, err
+	}
+	// authenticators without a counter always report zero
+	if authData.SignCount != 0 || cred.SignCount != 0 {
+		update := db.Model(cred).Where("sign_count < ?", authData.SignCount).Update("sign_count", authData.SignCount)
+		if update.Error != nil {
+			return 0, update.Error
+		}
+		if update.RowsAffected != 1 {
+			db.Model(cred).Update("blocked", true)
+			return 0, ErrWebAuthnSignCount
+		}
+	}
+	return cred.UserID, nil
+}
+
+func (w *WebAuthnServiceImpl) credentialDescriptors(ctx context.Context, id uint) ([]WebAuthnCredentialDescriptor, error) {
+	var creds []models.UserCredentials
+	err := w.Db.WithContext(ctx).Find(&creds, "user_id = ? and cred_type = ?", id, CredTypeWebAuthn).Error
+	if err != nil {
+		return nil, err
+	}
+	descriptors := make([]WebAuthnCredentialDescriptor, 0, len(creds))
+	for _, cred := range creds {
+		descriptor := WebAuthnCredentialDescriptor{Type: "public-key", ID: *cred.CredentialID}
+		if cred.Transports != "" {
+			descriptor.Transports = strings.Split(cred.Transports, ",")
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors, nil
+}
+
+func (w *WebAuthnServiceImpl) newChallenge(ctx context.Context, id uint, ceremony string) (string, error) {
+	random, err := GenerateRandomBytes(webAuthnChallengeLength)
+	if err != nil {
+		return "", err
+	}
+	challenge := &models.UserWebAuthnChallenge{
+		UserID:    id,
+		Challenge: b64url.EncodeToString(random),
+		Ceremony:  ceremony,
+		ExpiresAt: time.Now().Add(w.timeout()),
+	}
+	db := w.Db.WithContext(ctx)
+	err = db.Delete(&models.UserWebAuthnChallenge{}, "expires_at < ?", time.Now()).Error
+	if err != nil {
+		return "", err
+	}
+	if err = db.Create(challenge).Error; err != nil {
+		return "", err
+	}
+	return challenge.Challenge, nil
+}
+
+// verifyClientData checks the type and origin of the client data and consumes its challenge.
+func (w *WebAuthnServiceImpl) verifyClientData(ctx context.Context, clientDataJSON []byte, ceremony string) (*models.UserWebAuthnChallenge, error) {
+	clientData := struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}{}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+	if clientData.Type != ceremony {
+		return nil, fmt.Errorf("unexpected client data type %s", clientData.Type)
+	}
+	allowedOrigin := false
+	for _, origin := range w.Config.WebAuthnOrigins {
+		allowedOrigin = allowedOrigin || origin == clientData.Origin
+	}
+	if !allowedOrigin {
+		return nil, fmt.Errorf("origin %s not allowed", clientData.Origin)
+	}
+	db := w.Db.WithContext(ctx)
+	challenge := &models.UserWebAuthnChallenge{}
+	result := db.Find(challenge, "challenge = ? and ceremony = ? and expires_at > ?", clientData.Challenge, ceremony, time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, errors.New("unknown or expired webauthn challenge")
+	}
+	deleted := db.Delete(challenge)
+	if deleted.Error != nil {
+		return nil, deleted.Error
+	}
+	if deleted.RowsAffected != 1 {
+		return nil, errors.New("unknown or expired webauthn challenge")
+	}
+	return challenge, nil
+}
+
+type authenticatorData struct {
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// verifyAuthenticatorData parses the authenticator data and checks it is scoped to the relying party
+// with the user present, and verified when Config.WebAuthnUserVerification requires it.
+func (w *WebAuthnServiceImpl) verifyAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpIdHash := sha256.Sum256([]byte(w.Config.WebAuthnRPID))
+	if subtle.ConstantTimeCompare(data[:32], rpIdHash[:]) != 1 {
+		return nil, errors.New("authenticator data is not scoped to this relying party")
+	}
+	parsed := &authenticatorData{Flags: data[32], SignCount: binary.BigEndian.Uint32(data[33:37])}
+	if parsed.Flags&authenticatorFlagUserPresent == 0 {
+		return nil, errors.New("user presence not asserted")
+	}
+	if w.userVerification() == "required" && parsed.Flags&authenticatorFlagUserVerified == 0 {
+		return nil, errors.New("user verification required")
+	}
+	if parsed.Flags&authenticatorFlagAttested == 0 {
+		return parsed, nil
+	}
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	parsed.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, errors.New("attested credential data too short")
+	}
+	parsed.CredentialID = rest[:idLength]
+	var publicKey cbor.RawMessage
+	if err := cbor.NewDecoder(bytes.NewReader(rest[idLength:])).Decode(&publicKey); err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %w", err)
+	}
+	parsed.PublicKey = publicKey
+	return parsed, nil
+}
+
+func (w *WebAuthnServiceImpl) timeout() time.Duration {
+	if w.Config.WebAuthnTimeout > 0 {
+		return w.Config.WebAuthnTimeout
+	}
+	return defaultWebAuthnTimeout
+}
+
+func (w *WebAuthnServiceImpl) userVerification() string {
+	if w.Config.WebAuthnUserVerification != "" {
+		return w.Config.WebAuthnUserVerification
+	}
+	return "preferred"
+}
+
+func webAuthnUserHandle(id uint) []byte {
+	return []byte(strconv.FormatUint(uint64(id), 10))
+}
+
+// parseCOSEKey reads an EC2 P-256, OKP Ed25519 or RSA COSE public key.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	var key map[int]cbor.RawMessage
+	if err := cbor.Unmarshal(data, &key); err != nil {
+		return nil, 0, fmt.Errorf("invalid cose key: %w", err)
+	}
+	var keyType, algorithm int
+	if err := cbor.Unmarshal(key[1], &keyType); err != nil {
+		return nil, 0, errors.New("invalid cose key type")
+	}
+	if err := cbor.Unmarshal(key[3], &algorithm); err != nil {
+		return nil, 0, errors.New("invalid cose key algorithm")
+	}
+	var curve int
+	var x, y, n, e []byte
+	switch {
+	case keyType == 2 && algorithm == coseAlgES256:
+		if cbor.Unmarshal(key[-1], &curve) != nil || curve != 1 ||
+			cbor.Unmarshal(key[-2], &x) != nil || cbor.Unmarshal(key[-3], &y) != nil {
+			return nil, 0, errors.New("invalid cose ec2 key")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, errors.New("invalid cose ec2 key")
+		}
+		return publicKey, algorithm, nil
+	case keyType == 1 && algorithm == coseAlgEdDSA:
+		if cbor.Unmarshal(key[-1], &curve) != nil || curve != 6 || cbor.Unmarshal(key[-2], &x) != nil ||
+			len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid cose okp key")
+		}
+		return ed25519.PublicKey(x), algorithm, nil
+	case keyType == 3 && algorithm == coseAlgRS256:
+		if cbor.Unmarshal(key[-1], &n) != nil || cbor.Unmarshal(key[-2], &e) != nil || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid cose rsa key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, algorithm, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported cose key type %d with algorithm %d", keyType, algorithm)
+	}
+}
+
+func verifyWebAuthnSignature(publicKey crypto.PublicKey, algorithm int, signed []byte, signature []byte) error {
+	invalid := errors.New("invalid webauthn signature")
+	switch algorithm {
+	case coseAlgES256:
+		var ecSignature struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(signature, &ecSignature); err != nil || len(rest) != 0 {
+			return invalid
+		}
+		digest := sha256.Sum256(signed)
+		if !ecdsa.Verify(publicKey.(*ecdsa.PublicKey), digest[:], ecSignature.R, ecSignature.S) {
+			return invalid
+		}
+	case coseAlgEdDSA:
+		if !ed25519.Verify(publicKey.(ed25519.PublicKey), signed, signature) {
+			return invalid
+		}
+	case coseAlgRS256:
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) != nil {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/identityOrg/cerberus-core/models"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+// softAuthenticator is an ES256 authenticator without attestation.
+type softAuthenticator struct {
+	rpId         string
+	origin       string
+	credentialId []byte
+	key          *ecdsa.PrivateKey
+	signCount    uint32
+}
+
+func newSoftAuthenticator(rpId string, origin string) *softAuthenticator {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	credentialId, _ := GenerateRandomBytes(16)
+	return &softAuthenticator{rpId: rpId, origin: origin, credentialId: credentialId, key: key}
+}
+
+func padCoordinate(coordinate *big.Int) []byte {
+	raw := coordinate.Bytes()
+	return append(make([]byte, 32-len(raw)), raw...)
+}
+
+func (s *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": s.origin})
+	return data
+}
+
+func (s *softAuthenticator) authData(flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(s.rpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], s.signCount)
+	return data
+}
+
+func (s *softAuthenticator) create(challenge string) *WebAuthnAttestationResponse {
+	publicKey, _ := cbor.Marshal(map[int]interface{}{
+		1: 2, 3: coseAlgES256, -1: 1, -2: padCoordinate(s.key.X), -3: padCoordinate(s.key.Y),
+	})
+	authData := s.authData(authenticatorFlagUserPresent | authenticatorFlagAttested)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(s.credentialId)>>8), byte(len(s.credentialId)))
+	authData = append(authData, s.credentialId...)
+	authData = append(authData, publicKey...)
+	attestation, _ := cbor.Marshal(map[string]interface{}{"fmt": "none", "attStmt": map[string]interface{}{}, "authData": authData})
+	return &WebAuthnAttestationResponse{
+		ClientDataJSON:    s.clientData(webAuthnCeremonyCreate, challenge),
+		AttestationObject: attestation,
+		Transports:        []string{"internal"},
+	}
+}
+
+func (s *softAuthenticator) get(challenge string) *WebAuthnAssertionResponse {
+	s.signCount++
+	clientData := s.clientData(webAuthnCeremonyGet, challenge)
+	authData := s.authData(authenticatorFlagUserPresent)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, ss, _ := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	signature, _ := asn1.Marshal(struct{ R, S *big.Int }{r, ss})
+	return &WebAuthnAssertionResponse{
+		CredentialID:      b64url.EncodeToString(s.credentialId),
+		ClientDataJSON:    clientData,
+		AuthenticatorData: authData,
+		Signature:         signature,
+	}
+}
+
+func TestWebAuthnServiceImpl(t *testing.T) {
+	ctx := context.Background()
+	config := &Config{
+		WebAuthnRPID:           "localhost",
+		WebAuthnOrigins:        []string{"https://localhost:8080"},
+		MaxInvalidLoginAttempt: 3,
+	}
+	service := NewWebAuthnServiceImpl(beginTransaction(ctx, TestDb), config)
+	authenticator := newSoftAuthenticator("localhost", "https://localhost:8080")
+	id := TestNoCredUser.ID
+	t.Run("register", func(t *testing.T) {
+		options, err := service.BeginWebAuthnRegistration(ctx, id)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Empty(t, options.ExcludeCredentials)
+		credentialId, err := service.FinishWebAuthnRegistration(ctx, id, "laptop", authenticator.create(options.Challenge))
+		if assert.NoError(t, err) {
+			assert.Equal(t, b64url.EncodeToString(authenticator.credentialId), credentialId)
+		}
+		_, err = service.FinishWebAuthnRegistration(ctx, id, "laptop", authenticator.create(options.Challenge))
+		assert.Error(t, err, "challenge consumed")
+		options, err = service.BeginWebAuthnRegistration(ctx, id)
+		if assert.NoError(t, err) {
+			assert.Len(t, options.ExcludeCredentials, 1)
+		}
+	})
+	t.Run("wrong origin", func(t *testing.T) {
+		options, err := service.BeginWebAuthnRegistration(ctx, id)
+		if !assert.NoError(t, err) {
+			return
+		}
+		other := newSoftAuthenticator("localhost", "https://evil.com")
+		_, err = service.FinishWebAuthnRegistration(ctx, id, "other", other.create(options.Challenge))
+		assert.Error(t, err)
+	})
+	t.Run("login", func(t *testing.T) {
+		options, err := service.BeginWebAuthnLogin(ctx, TestNoCredUser.Username)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, options.AllowCredentials, 1)
+		userId, err := service.FinishWebAuthnLogin(ctx, authenticator.get(options.Challenge))
+		if assert.NoError(t, err) {
+			assert.Equal(t, id, userId)
+		}
+		options, err = service.BeginWebAuthnLogin(ctx, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		userId, err = service.FinishWebAuthnLogin(ctx, authenticator.get(options.Challenge))
+		if assert.NoError(t, err) {
+			assert.Equal(t, id, userId, "discoverable login")
+		}
+	})
+	t.Run("bad signature", func(t *testing.T) {
+		options, err := service.BeginWebAuthnLogin(ctx, TestNoCredUser.Username)
+		if !assert.NoError(t, err) {
+			return
+		}
+		response := authenticator.get(options.Challenge)
+		response.Signature[len(response.Signature)-1] ^= 0xff
+		_, err = service.FinishWebAuthnLogin(ctx, response)
+		assert.Error(t, err)
+	})
+	t.Run("cloned authenticator", func(t *testing.T) {
+		options, err := service.BeginWebAuthnLogin(ctx, TestNoCredUser.Username)
+		if !assert.NoError(t, err) {
+			return
+		}
+		authenticator.signCount = 0
+		_, err = service.FinishWebAuthnLogin(ctx, authenticator.get(options.Challenge))
+		assert.Equal(t, ErrWebAuthnSignCount, err)
+		cred := &models.UserCredentials{}
+		service.Db.Find(cred, "user_id = ? and cred_type = ?", id, CredTypeWebAuthn)
+		assert.True(t, cred.Bocked)
+	})
+	t.Run("credential id unique", func(t *testing.T) {
+		credentialId := b64url.EncodeToString(authenticator.credentialId)
+		duplicate := &models.UserCredentials{
+			UserID:       TestNoCredUser2.ID,
+			Type:         CredTypeWebAuthn,
+			CredentialID: &credentialId,
+		}
+		assert.Error(t, service.Db.Create(duplicate).Error)
+	})
+	t.Run("deleted user", func(t *testing.T) {
+		service.Db.Model(&models.UserCredentials{}).Where("user_id = ?", id).Update("blocked", false)
+		if !assert.NoError(t, service.Db.Delete(&models.UserModel{}, id).Error) {
+			return
+		}
+		options, err := service.BeginWebAuthnLogin(ctx, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = service.FinishWebAuthnLogin(ctx, authenticator.get(options.Challenge))
+		assert.EqualError(t, err, fmt.Sprintf("user not found with id %d", id))
+	})
+	rollbackTransaction(service.Db)
+}
@@ -11,6 +11,13 @@ var ProviderSet = wire.NewSet(
 	NewUserStoreServiceImpl,
 	NewScopeClaimStoreServiceImpl,
 	NewSecretStoreServiceImpl,
+	NewSigningSecretStore,
+	NewJOSEServiceImpl,
+	NewPasswordResetServiceImpl,
+	NewWebAuthnServiceImpl,
+	NewNotificationServiceImpl,
+	NewEmailVerificationServiceImpl,
+	NewMagicLinkServiceImpl,
 	wire.Bind(new(ITokenStoreService), new(*TokenStoreServiceImpl)),
 	wire.Bind(new(oidcsdk.ITokenStore), new(*TokenStoreServiceImpl)),
 	wire.Bind(new(ISPStoreService), new(*SPStoreServiceImpl)),
@@ -18,6 +25,13 @@ var ProviderSet = wire.NewSet(
 	wire.Bind(new(IUserStoreService), new(*UserStoreServiceImpl)),
 	wire.Bind(new(oidcsdk.IUserStore), new(*UserStoreServiceImpl)),
 	wire.Bind(new(ISecretStoreService), new(*SecretStoreServiceImpl)),
-	wire.Bind(new(oidcsdk.ISecretStore), new(*SecretStoreServiceImpl)),
+	wire.Bind(new(oidcsdk.ISecretStore), new(*SigningSecretStore)),
 	wire.Bind(new(IScopeClaimStoreService), new(*ScopeClaimStoreServiceImpl)),
+	wire.Bind(new(IJOSEService), new(*JOSEServiceImpl)),
+	wire.Bind(new(IPasswordResetService), new(*PasswordResetServiceImpl)),
+	wire.Bind(new(IWebAuthnService), new(*WebAuthnServiceImpl)),
+	wire.Bind(new(INotificationService), new(*NotificationServiceImpl)),
+	wire.Bind(new(IPasswordResetNotifier), new(*NotificationServiceImpl)),
+	wire.Bind(new(IEmailVerificationService), new(*EmailVerificationServiceImpl)),
+	wire.Bind(new(IMagicLinkService), new(*MagicLinkServiceImpl)),
 )